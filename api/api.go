@@ -2,16 +2,20 @@ package api
 
 import (
 	"context"
+	"crypto"
+	"encoding/json"
 	"fmt"
-	"net"
+	"html/template"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"regexp"
+	"path"
 	"strings"
-	"sync"
 	"time"
 
 	containerdarchive "github.com/containerd/containerd/archive"
+	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/docker/go-units"
 	"github.com/lthibault/jitterbug"
 	"github.com/moby/moby/api/types"
@@ -28,59 +32,122 @@ import (
 
 // API returns a new containerbay instance
 type API struct {
-	listenAddr        string
-	dnsTXTKey         string
-	magicDNS          string
-	standaloneImage   string
-	defaultImage      string
-	whitelist         []string
-	whitergx          []*regexp.Regexp
-	cacheStore        *store.Store
-	maxSize           int64
-	poolSize, workers int
-	pool              chan workPackage
-	cleanupInterval   time.Duration
-	auth              *types.AuthConfig
-
-	mu sync.Mutex
+	listenAddr         string
+	dnsTXTKey          string
+	magicDNS           string
+	standaloneImage    string
+	standaloneRoot     string
+	defaultImage       string
+	policy             policyStore
+	routes             routeTable
+	denylist           denylist
+	adminToken         string
+	domainSecret       string
+	domainVerification bool
+	storeDir           string
+	storeMaxSize       int64
+	storeMaxAge        time.Duration
+	cacheStore         *store.Store
+	maxSize            int64
+	spa                bool
+	labels             map[string]bool
+	poolSize, workers  int
+	pool               chan workPackage
+	errorImage         string
+	errorPages         map[string][]byte
+	cleanupInterval    time.Duration
+	auth               *types.AuthConfig
+	credentials        Credentials
+	credentialsFile    string
+	dockerConfig       string
+	defaultKeychain    bool
+	platform           *v1.Platform
+	signatures         signatureVerifier
+	resolver           resolveCache
+	rules              rulesCache
+	dns                txtResolver
+	downloads          downloads
+
+	wait, maxWait, retryAfter time.Duration
+	processingPage            string
+	processingTmpl            *template.Template
 }
 
 type workPackage struct {
-	img, dst string
+	// img is the digest reference to download, source the
+	// reference it was requested with
+	img, source, key, digest, platform string
+	// index is the digest of the index the image was
+	// resolved from, if any, layers the image layers digests
+	index  string
+	layers []string
+	// root is the root of the site served from the image
+	root string
+
+	release  func()
+	progress *download
 }
 
-func (a *API) downloadImage(image, dst string) error {
-	// Let just one of the routine go and handle the download
-	a.mu.Lock()
-	if _, err := os.Stat(dst); err == nil {
-		a.mu.Unlock()
+func (a *API) downloadImage(w workPackage) error {
+	image := w.img
+
+	// Downloads are de-duplicated before being queued,
+	// the content might be already there from a previous run though
+	if a.cacheStore.Exists(w.key) {
 		return nil
 	}
-	os.MkdirAll(dst, os.ModePerm)
-	a.mu.Unlock()
+	dst, err := a.cacheStore.Stage(w.key)
+	if err != nil {
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			os.RemoveAll(dst)
+		}
+	}()
 
-	os.MkdirAll(fmt.Sprintf("%s.lock", dst), 0600)
-	defer os.RemoveAll(fmt.Sprintf("%s.lock", dst))
+	meta := store.Entry{
+		Key:       w.key,
+		Reference: w.source,
+		Platform:  w.platform,
+		Digest:    w.digest,
+		Index:     w.index,
+		Layers:    w.layers,
+	}
+	if err := a.cacheStore.Begin(meta); err != nil {
+		return err
+	}
 
 	pterm.Info.Printfln("Downloading %s to %s", image, dst)
+	w.progress.setState(jobDownloading)
 	ref, err := name.ParseReference(image)
 	if err != nil {
 		return err
 	}
 
-	var img v1.Image
+	transport := remote.WithTransport(&progressTransport{inner: http.DefaultTransport, download: w.progress})
+	img, err := remote.Image(ref, a.remoteOptions(transport)...)
+	if err != nil {
+		return err
+	}
 
-	if a.auth != nil {
-		img, err = remote.Image(ref, remote.WithAuth(staticAuth{a.auth}))
-		if err != nil {
-			return err
-		}
-	} else {
-		img, err = remote.Image(ref)
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	progress := []layerProgress{}
+	for _, l := range layers {
+		d, err := l.Digest()
 		if err != nil {
 			return err
 		}
+		size, _ := l.Size()
+		progress = append(progress, layerProgress{Digest: d.String(), Size: size})
 	}
+	w.progress.setLayers(progress)
+	w.progress.setState(jobExtracting)
 
 	reader := mutate.Extract(img)
 
@@ -91,7 +158,42 @@ func (a *API) downloadImage(image, dst string) error {
 		return err
 	}
 
-	pterm.Info.Printfln("Downloaded %s to %s", image, dst)
+	// Drain what's left of the stream, so errors from layers
+	// failing verification at the very end are surfaced
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return errors.Wrap(err, "while verifying the extracted image")
+	}
+
+	// Redirects and headers rules are parsed once, and kept in the index
+	rules := map[string]*siteRules{}
+	for _, root := range []string{"/", w.root} {
+		dir, err := securejoin.SecureJoin(dst, root)
+		if err != nil {
+			return errors.Wrapf(err, "while resolving root '%s'", root)
+		}
+		if rules[siteRoot(dst, dir)], err = loadSiteRules(dir); err != nil {
+			return errors.Wrap(err, "while loading the site rules")
+		}
+	}
+	dat, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	if err := a.cacheStore.SetMeta(w.key, dat); err != nil {
+		return err
+	}
+
+	// The image might have been blocked while downloading it
+	if a.denylist.blocks(meta) {
+		return errors.Errorf("image '%s' is blocked", w.source)
+	}
+
+	committed = true
+	if err := a.cacheStore.Commit(w.key); err != nil {
+		return err
+	}
+
+	pterm.Info.Printfln("Downloaded %s to %s", image, a.cacheStore.Path(w.key))
 
 	return nil
 }
@@ -110,7 +212,11 @@ type errorMessage struct {
 }
 
 func retError(c echo.Context, template string, i ...interface{}) error {
-	return c.JSON(http.StatusInternalServerError, errorMessage{Error: fmt.Sprintf(template, i...)})
+	return retErrorCode(c, http.StatusInternalServerError, template, i...)
+}
+
+func retErrorCode(c echo.Context, code int, template string, i ...interface{}) error {
+	return c.JSON(code, errorMessage{Error: fmt.Sprintf(template, i...)})
 }
 
 func (a *API) startWorkers() {
@@ -119,10 +225,18 @@ func (a *API) startWorkers() {
 	for i := 0; i < a.workers; i++ {
 		go func() {
 			for f := range a.pool {
-				err := a.downloadImage(f.img, f.dst)
+				err := a.downloadImage(f)
 				if err != nil {
 					pterm.Error.Printfln("Download failed: %s", err.Error())
-					os.RemoveAll(f.dst)
+					a.cacheStore.Remove(f.key)
+				}
+				f.release()
+				a.downloads.finish(f.key, err)
+				if err != nil {
+					continue
+				}
+				if err := a.cacheStore.Prune(); err != nil {
+					pterm.Error.Println("error while pruning the store:", err)
 				}
 			}
 		}()
@@ -155,88 +269,206 @@ func (a *API) cleanupWorker(ctx context.Context) {
 	}()
 }
 
-func (a *API) renderImage(c echo.Context, image, strip string) error {
-	if len(a.whitergx) > 0 {
-		ok := false
-		for _, r := range a.whitergx {
-			if r.MatchString(image) {
-				ok = true
-			}
-		}
-		if !ok {
-			return retError(c, "forbidden image '%s'", image)
-		}
-	}
+// site is an image to serve and how to serve it
+type site struct {
+	image    string
+	platform *v1.Platform
+	// root is the directory of the image served as web root
+	root string
+	// spa serves index.html for the missing paths which are not assets
+	spa bool
+	// domain has to be allowed by the image label, if set
+	domain string
+
+	// cacheControl is the default Cache-Control of the responses
+	cacheControl string
+	// cors are the origins allowed to request the files, * for any
+	cors []string
+	// index are the names of the index files of directories
+	index []string
+}
 
+func (a *API) renderImage(c echo.Context, s site, strip string) error {
+	image := s.image
 	ref, err := name.ParseReference(image)
 	if err != nil {
-		return retError(c, "while parsing image reference '%s'", err.Error())
+		return a.renderError(c, newHTTPError(http.StatusBadRequest, "invalid image reference '%s': %s", image, err.Error()), nil)
+	}
+
+	if _, blocked := a.denylist.blockedReference(ref); blocked {
+		pterm.Warning.Printfln("Refusing to serve blocked image '%s'", image)
+		return a.renderError(c, newHTTPError(http.StatusForbidden, "image '%s' is blocked", image), nil)
+	}
+
+	// Refuse early what the policy denies regardless of the resolution
+	policy := a.policy.get()
+	if allow, _, ok := policy.decide(image, ref, nil); ok && !allow {
+		return a.renderError(c, newHTTPError(http.StatusForbidden, "forbidden image '%s'", image), nil)
 	}
 
-	img, err := remote.Image(ref)
+	platform, err := a.requestPlatform(c, s.platform)
 	if err != nil {
-		return retError(c, "while fetching remote image reference '%s'", err.Error())
+		return a.renderError(c, newHTTPError(http.StatusBadRequest, "while parsing platform: %s", err.Error()), nil)
+	}
+
+	res, err := a.resolveImage(image, platform)
+	if err != nil {
+		return a.renderError(c, registryError(err, "while fetching remote image reference '%s'", image), nil)
+	}
+
+	if s.domain != "" && !domainAllowed(res.labels, s.domain) {
+		pterm.Warning.Printfln("Refusing to serve image '%s' for unverified domain '%s'", image, s.domain)
+		return a.renderError(c, newHTTPError(http.StatusForbidden, "domain '%s' is not verified for image '%s'", s.domain, image), nil)
+	}
+
+	if e, blocked := a.denylist.blockedDigest(res.digests()...); blocked {
+		pterm.Warning.Printfln("Refusing to serve image '%s' (%s): %s is blocked", image, res.digest, e.Digest)
+		return a.renderError(c, newHTTPError(http.StatusForbidden, "image '%s' is blocked", image), nil)
+	}
+
+	allow, rule, _ := policy.decide(image, ref, res)
+	if !allow {
+		pterm.Warning.Printfln("Refusing to serve image '%s' (%s): denied by policy", image, res.digest)
+		return a.renderError(c, newHTTPError(http.StatusForbidden, "forbidden image '%s'", image), nil)
+	}
+
+	// Platforms are listed only for images which could be served
+	if res.noMatch {
+		return renderPlatforms(c, http.StatusNotFound, image, res)
+	}
+	if isPlatformsRequest(c) {
+		return renderPlatforms(c, http.StatusOK, image, res)
+	}
+
+	maxSize := a.maxSize
+	var keys []crypto.PublicKey
+	if rule != nil {
+		if rule.maxSize != 0 {
+			maxSize = rule.maxSize
+		}
+		keys = rule.keys
 	}
 
-	size := imageSize(img)
-	if a.maxSize != 0 && size > a.maxSize {
+	size := res.size
+	if maxSize != 0 && size > maxSize {
 		pterm.Warning.Printfln("Refusing to serve image '%s' (size: %s)", image, units.HumanSize(float64(size)))
-		return retError(c, "max size exceeded: image %d, threshold %d", size, a.maxSize)
+		return a.renderError(c, newHTTPError(http.StatusRequestEntityTooLarge, "max size exceeded: image %d, threshold %d", size, maxSize), nil)
+	}
+
+	if err := a.signatures.verify(image, res, keys, a.resolver.negativeTTL, a.remoteOptions()...); err != nil {
+		pterm.Warning.Printfln("Refusing to serve image '%s' (%s): signature verification failed: %s", image, res.digest, err.Error())
+		return a.renderError(c, newHTTPError(http.StatusForbidden, "signature verification failed for image '%s': %s", image, err.Error()), nil)
 	}
 
 	pterm.Info.Printfln("Serving image: %s Size: %s", image, units.HumanSize(float64(size)))
 
-	h, err := img.Digest()
-	if err != nil {
-		return retError(c, "while getting image digest: %s", err.Error())
-	}
+	s = a.applyLabels(s, res.labels)
+	s.spa = s.spa || a.spa
+
+	key := res.key()
+
+	// Hold the entry so it can't be evicted while we serve it
+	release := a.cacheStore.Acquire(key)
+	defer release()
 
 	// If doesn't exist in cache we have to download it
 	// We let the worker download them, and handle the request separately
-	if !a.cacheStore.Exists(h.Hex) {
-		pterm.Info.Printfln("Not present in cache %s: %s Size: %s", h.Hex, image, units.HumanSize(float64(size)))
-		a.pool <- workPackage{img: image, dst: a.cacheStore.Path(h.Hex)}
-		return c.HTML(202, "Processing the request, try again soon.")
+	if !a.cacheStore.Exists(key) {
+		pterm.Info.Printfln("Not present in cache %s: %s Size: %s", key, image, units.HumanSize(float64(size)))
+		dl := a.fetch(workPackage{
+			img:      res.ref.String(),
+			source:   image,
+			key:      key,
+			digest:   res.digest.String(),
+			platform: platformString(res.platform),
+			index:    res.indexDigest(),
+			layers:   res.layerDigests(),
+			root:     s.root,
+		})
+		if !waitDownload(c.Request().Context(), dl, a.requestWait(c)) {
+			return a.processing(c, image)
+		}
+		if err := dl.Err(); err == errQueueFull {
+			return a.busy(c, image)
+		} else if err != nil {
+			return a.renderError(c, registryError(err, "while downloading image '%s'", image), nil)
+		}
 	}
 
-	if _, err := os.Stat(fmt.Sprintf("%s.lock", a.cacheStore.Path(h.Hex))); err == nil {
-		return c.HTML(202, "Still processing, try again soon.")
-	}
+	pterm.Info.Printfln("Render from cache %s: %s Size: %s", key, image, units.HumanSize(float64(size)))
 
-	pterm.Info.Printfln("Render from cache %s: %s Size: %s", h.Hex, image, units.HumanSize(float64(size)))
+	// Symlinks are resolved inside the image, so the root can't be outside of it
+	dir, err := securejoin.SecureJoin(a.cacheStore.Path(key), s.root)
+	if err != nil {
+		return a.renderError(c, errors.Wrapf(err, "while resolving root '%s'", s.root), nil)
+	}
 
-	return echo.WrapHandler(
-		http.StripPrefix(strip, http.FileServer(http.Dir(a.cacheStore.Path(h.Hex)))))(c)
+	return a.serveFiles(c, s, rootFileSystem(dir), strip, a.siteRulesFor(key, dir))
 }
 
-func (a *API) containerFromDomain(domain string) (string, error) {
-
-	pterm.Debug.Printfln("(magicDNS) Querying TXT records for domain '%s'", domain)
+// serveFiles serves the files of root for s, with the path stripped of
+// strip, applying the redirects and headers rules of the site if any.
+// Missing files are replied with the 404 page of root, if any
+func (a *API) serveFiles(c echo.Context, s site, root http.FileSystem, strip string, rules *siteRules) error {
+	req := c.Request()
+	name := path.Clean("/" + strings.TrimPrefix(req.URL.Path, strip))
 
-	txtrecords, err := net.LookupTXT(domain)
-	if err != nil {
-		return "", err
+	fs := root
+	if s.spa {
+		fs = spaFileSystem{root}
 	}
 
-	pterm.Debug.Printfln("(magicDNS) Found '%v' for domain '%s'", txtrecords, domain)
+	h := c.Response().Header()
+	if origin := req.Header.Get(echo.HeaderOrigin); origin != "" && len(s.cors) > 0 {
+		h.Add(echo.HeaderVary, echo.HeaderOrigin)
+		for _, o := range s.cors {
+			if o == "*" || o == origin {
+				h.Set(echo.HeaderAccessControlAllowOrigin, o)
+				break
+			}
+		}
+	}
+	if rules != nil {
+		rules.setHeaders(h, name)
+	}
+	if s.cacheControl != "" && h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", s.cacheControl)
+	}
 
-	for _, txt := range txtrecords {
-		dat := strings.Split(txt, " ")
-		pterm.Debug.Printfln("(magicDNS) txt record '%v' for domain '%s'", txt, domain)
+	if rules != nil {
+		if r, params, ok := rules.redirect(name); ok && (r.Force || !exists(root, name)) {
+			to := r.target(params)
+			if r.Status == http.StatusOK || r.Status == http.StatusNotFound {
+				return a.serveRewrite(c, fs, to, r.Status)
+			}
+			if !r.external() {
+				to = strings.TrimSuffix(strip, "/") + to
+			}
+			if req.URL.RawQuery != "" && !strings.Contains(to, "?") {
+				to += "?" + req.URL.RawQuery
+			}
+			return c.Redirect(r.Status, to)
+		}
+	}
 
-		if len(dat) > 0 {
-			record := dat[0]
-			//	dd := dat[1]
-			// if dd != domain { continue }
-			r := strings.Split(record, "=")
-			if len(r) > 0 {
-				if r[0] == a.dnsTXTKey {
-					return r[1], nil
+	f, err := fs.Open(name)
+	if os.IsNotExist(err) {
+		return a.renderError(c, newHTTPError(http.StatusNotFound, "'%s' not found", name), fs)
+	}
+	if err == nil {
+		st, serr := f.Stat()
+		f.Close()
+		// Directories are served by the file server if there is no other index
+		if serr == nil && st.IsDir() && strings.HasSuffix(req.URL.Path, "/") {
+			for _, index := range s.index {
+				if p := path.Join(name, index); exists(root, p) {
+					return a.serveRewrite(c, fs, p, http.StatusOK)
 				}
 			}
 		}
 	}
-	return "", errors.New("record not found")
+	return echo.WrapHandler(
+		http.StripPrefix(strip, http.FileServer(fs)))(c)
 }
 
 // EchoOption is a generic handler which mutates the underlying Echo instance
@@ -245,81 +477,165 @@ type EchoOption func(e *echo.Echo) error
 // Start starts the API with the given EchoOption
 func (a *API) Start(opts ...EchoOption) error {
 
-	a.pool = make(chan workPackage, a.poolSize)
-	a.startWorkers()
-	a.cleanupWorker(context.Background())
-	a.cacheStore.CleanAll()
+	a.cacheStore = store.New(a.storeDir,
+		store.WithMaxSize(a.storeMaxSize),
+		store.WithMaxAge(a.storeMaxAge),
+	)
+	if err := a.cacheStore.Open(); err != nil {
+		return err
+	}
+	defer a.cacheStore.Close()
+
+	if a.denylist.file == "" {
+		a.denylist.file = a.cacheStore.Path(denylistFile)
+	}
+	if err := a.denylist.load(); err != nil {
+		return err
+	}
+	pterm.Info.Printfln("Denylist at '%s' with '%d' entries", a.denylist.file, len(a.denylist.list()))
+	// Content might have been blocked while we were not running
+	purged, err := a.cacheStore.RemoveWhere(a.denylist.blocks)
+	if err != nil {
+		return errors.Wrap(err, "while purging blocked images")
+	}
+	for _, key := range purged {
+		pterm.Warning.Printfln("Purged blocked '%s' from the store", key)
+	}
 
-	for _, w := range a.whitelist {
-		r, err := regexp.Compile(w)
+	if err := a.loadProcessingPage(); err != nil {
+		return errors.Wrap(err, "while loading the processing page")
+	}
+
+	if a.credentialsFile != "" {
+		creds, err := LoadCredentials(a.credentialsFile)
 		if err != nil {
 			return err
 		}
-		a.whitergx = append(a.whitergx, r)
+		if a.credentials == nil {
+			a.credentials = Credentials{}
+		}
+		for k, v := range creds {
+			a.credentials[k] = v
+		}
+	}
+	for k := range a.credentials {
+		pterm.Info.Printfln("Registry credentials for '%s'", k)
+	}
+
+	if err := a.signatures.load(); err != nil {
+		return errors.Wrap(err, "while loading signature verification keys")
+	}
+	for _, p := range a.signatures.policies {
+		pterm.Info.Printfln("Images matching '%s' must be signed by %v", p.rawPattern, p.keyPaths)
+	}
+
+	// Verifications might have been done with keys the new policy doesn't require
+	a.policy.onReload = a.signatures.reset
+	if err := a.policy.load(); err != nil {
+		return errors.Wrap(err, "while loading the policy")
+	}
+	if a.policy.file != "" {
+		pterm.Info.Printfln("Policy '%s'", a.policy.file)
+	}
+	for _, w := range a.policy.whitelist {
 		pterm.Info.Printfln("Whitelist '%s'", w)
 	}
 
+	if a.errorImage != "" {
+		// Error pages are needed the most when registries fail, don't depend on them later
+		if err := a.loadErrorPages(); err != nil {
+			pterm.Warning.Printfln("Failed loading error pages from '%s': %s", a.errorImage, err.Error())
+		} else {
+			pterm.Info.Printfln("'%d' error pages from '%s'", len(a.errorPages), a.errorImage)
+		}
+	}
+
+	a.pool = make(chan workPackage, a.poolSize)
+	a.startWorkers()
+	a.cleanupWorker(context.Background())
+	watchFile(context.Background(), a.policy.file, "policy", a.policy.load)
+
+	if err := a.routes.load(); err != nil {
+		return errors.Wrap(err, "while loading the routes")
+	}
+	pterm.Info.Printfln("'%d' static routes", a.routes.len())
+	watchFile(context.Background(), a.routes.file, "routes", a.routes.load)
+
 	ec := echo.New()
 	for _, o := range opts {
 		o(ec)
 	}
+	ec.Use(a.serveRoutes)
 
 	pterm.Info.Printfln("Cachestore dir at '%s'", a.cacheStore)
 	pterm.Info.Printfln("Max image size '%s'", units.HumanSize(float64(a.maxSize)))
+	pterm.Info.Printfln("Max store size '%s', max idle age '%s'", units.HumanSize(float64(a.storeMaxSize)), a.storeMaxAge)
 	pterm.Info.Printfln("Default image '%s'", a.defaultImage)
 
+	if a.dns.server == "" {
+		a.dns.server = systemDNSServer()
+	}
+	pterm.Info.Printfln("DNS resolver '%s', TTL between '%s' and '%s'", a.dns.server, a.dns.minTTL, a.dns.maxTTL)
+	if a.domainVerification {
+		pterm.Info.Printfln("Domain verification enabled, tokens accepted: %t", a.domainSecret != "")
+	}
+
+	ec.GET("/_containerbay/metrics", a.getMetrics)
+	ec.GET("/_containerbay/jobs", a.listJobs)
+	ec.GET("/_containerbay/jobs/:digest", a.getJob)
+	ec.GET("/_containerbay/jobs/:digest/events", a.jobEvents)
+
+	if a.adminToken != "" {
+		admin := ec.Group("/_containerbay/admin", a.adminAuth)
+		admin.GET("/denylist", a.listDenylist)
+		admin.POST("/denylist", a.addDenylist)
+		admin.DELETE("/denylist", a.removeDenylist)
+	} else {
+		pterm.Info.Println("Admin endpoints disabled, no admin token set")
+	}
+
 	if a.standaloneImage != "" {
 		ec.GET("/*", func(c echo.Context) error {
-			return a.renderImage(c, a.standaloneImage, "/")
+			return a.renderImage(c, site{image: a.standaloneImage, root: a.standaloneRoot}, "/")
 		})
 	} else {
 		ec.GET("/*", func(c echo.Context) error {
 			req := c.Request()
+
+			// Hosts bound to a site serve its files at any path
 			host := req.Host
 			if a.magicDNS != "" {
-				dns := a.magicDNS
-				if !strings.HasPrefix(dns, ".") {
-					dns = "." + dns
-				}
-				hostdots := strings.ReplaceAll(host, dns, "")
-				fields := strings.Split(hostdots, ".")
-
-				pterm.Info.Printfln("Trying to resolve magicDNS(%s) for '%s'", dns, host)
-
-				// A host can be: registry.org.container.tag
-				if len(fields) >= 4 {
-					var tag, org, container, registry string
-
-					// pop the required fields
-					tag, fields = fields[len(fields)-1], fields[:len(fields)-1]
-					container, fields = fields[len(fields)-1], fields[:len(fields)-1]
-					org, fields = fields[len(fields)-1], fields[:len(fields)-1]
-
-					registry = strings.Join(fields, ".") // recompose registry
-
-					// compose image name
-					image := fmt.Sprintf("%s/%s/%s:%s", registry, org, container, tag)
+				pterm.Info.Printfln("Trying to resolve magicDNS(%s) for '%s'", a.magicDNS, host)
+				if image, ok := parseMagicHost(host, a.magicDNS); ok {
 					pterm.Info.Printfln("magicDNS resolved '%s'", image)
-					return a.renderImage(c, image, "/")
+					return a.renderImage(c, site{image: image}, "/")
 				}
 			}
-			if container, err := a.containerFromDomain(host); err == nil {
-				pterm.Info.Printfln("magicDNS from dns domain resolved '%s'", container)
-				return a.renderImage(c, container, "/")
+			if record, err := a.containerFromDomain(host); err == nil {
+				pterm.Info.Printfln("magicDNS from dns domain resolved '%s'", record.image)
+				return a.renderImage(c, record.site(), "/")
 			} else {
 				pterm.Debug.Printfln("(magicDNS) failed getting records from TXT '%s'", err.Error())
 			}
 
-			return a.renderImage(c, a.defaultImage, "/")
-		})
+			p, err := parseImagePath(req.URL.Path)
+			if err != nil {
+				return a.renderError(c, newHTTPError(http.StatusBadRequest, "while parsing platform: %s", err.Error()), nil)
+			}
+			// With a default image, only paths as long as /registry/org/container/
+			// select an image, as e.g. /static.v2/js/app.js is a file of the site
+			if p != nil && (a.defaultImage == "" || strings.Count(req.URL.Path, "/") > 3) {
+				if !strings.HasPrefix(req.URL.Path, p.prefix) {
+					u := *req.URL
+					u.Path += "/"
+					return c.Redirect(http.StatusMovedPermanently, u.RequestURI())
+				}
+				return a.renderImage(c, site{image: p.image, platform: p.platform}, p.prefix)
+			}
 
-		ec.GET("/:registry/:org/:container/*", func(c echo.Context) error {
-			org := c.Param("org")
-			container := c.Param("container")
-			registry := c.Param("registry")
-			image := fmt.Sprintf("%s/%s/%s", registry, org, container)
-			return a.renderImage(c, image, fmt.Sprintf("/%s/", image))
+			return a.renderImage(c, site{image: a.defaultImage}, "/")
 		})
+
 	}
 	return ec.Start(a.listenAddr)
 }
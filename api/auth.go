@@ -1,8 +1,16 @@
 package api
 
 import (
+	"os"
+	"strings"
+
+	"github.com/docker/cli/cli/config/configfile"
+	clitypes "github.com/docker/cli/cli/config/types"
 	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/moby/moby/api/types"
+	"github.com/pkg/errors"
 )
 
 type staticAuth struct {
@@ -22,3 +30,87 @@ func (s staticAuth) Authorization() (*authn.AuthConfig, error) {
 		RegistryToken: s.auth.RegistryToken,
 	}, nil
 }
+
+// Resolve returns the static authentication for the targets of its
+// server address, or for all of them if it has none
+func (s staticAuth) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if s.auth == nil || (s.auth.ServerAddress != "" && !sameRegistry(s.auth.ServerAddress, target.RegistryStr())) {
+		return authn.Anonymous, nil
+	}
+	return s, nil
+}
+
+// sameRegistry returns true if address, as found in docker configurations
+// (e.g. https://index.docker.io/v1/), points to registry
+func sameRegistry(address, registry string) bool {
+	address = strings.TrimPrefix(strings.TrimPrefix(address, "https://"), "http://")
+	address = strings.SplitN(address, "/", 2)[0]
+	r, err := name.NewRegistry(address)
+	return err == nil && r.RegistryStr() == registry
+}
+
+// dockerConfigKeychain resolves credentials from a docker config.json file,
+// including the credential helpers it refers to
+type dockerConfigKeychain struct {
+	path string
+}
+
+// Resolve implements authn.Keychain
+func (d dockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	f, err := os.Open(d.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while opening docker config '%s'", d.path)
+	}
+	defer f.Close()
+
+	cf := configfile.New(d.path)
+	if err := cf.LoadFromReader(f); err != nil {
+		return nil, errors.Wrapf(err, "while reading docker config '%s'", d.path)
+	}
+
+	key := target.RegistryStr()
+	if key == name.DefaultRegistry {
+		key = authn.DefaultAuthKey
+	}
+
+	cfg, err := cf.GetAuthConfig(key)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == (clitypes.AuthConfig{}) {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
+
+// keychain returns the keychain used to authenticate against registries.
+// Credentials of policy rules come first, then per registry credentials,
+// static credentials, the docker config file and the default docker keychain, if enabled
+func (a *API) keychain() authn.Keychain {
+	keychains := []authn.Keychain{&a.policy}
+	if len(a.credentials) > 0 {
+		keychains = append(keychains, a.credentials)
+	}
+	if a.auth != nil {
+		keychains = append(keychains, staticAuth{a.auth})
+	}
+	if a.dockerConfig != "" {
+		keychains = append(keychains, dockerConfigKeychain{path: a.dockerConfig})
+	}
+	if a.defaultKeychain {
+		keychains = append(keychains, authn.DefaultKeychain)
+	}
+	return authn.NewMultiKeychain(keychains...)
+}
+
+// remoteOptions returns the options for registry calls,
+// authenticated with the instance credentials
+func (a *API) remoteOptions(opts ...remote.Option) []remote.Option {
+	return append([]remote.Option{remote.WithAuthFromKeychain(a.keychain())}, opts...)
+}
@@ -0,0 +1,262 @@
+package api
+
+import (
+	"io/ioutil"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the content of a configuration file, mapping to the
+// Options of an instance, e.g.:
+//
+//	address: ":8080"
+//	magicDNS: containerbay.io
+//	store:
+//	  dir: /var/cache/containerbay
+//	  maxSize: 20GB
+//	resolve:
+//	  ttl: 5m
+//	registries:
+//	  credentials:
+//	    ghcr.io/ourorg:
+//	      username: bot
+//	      password:
+//	        env: GHCR_TOKEN
+//	routes:
+//	- host: www.example.com
+//	  image: ghcr.io/ourorg/website:latest
+//	policy:
+//	  rules:
+//	  - action: allow
+//	    match:
+//	      registry: ghcr.io
+//	  default: deny
+type Config struct {
+	Address      string `json:"address,omitempty"`
+	Gzip         bool   `json:"gzip,omitempty"`
+	Debug        bool   `json:"debug,omitempty"`
+	Standalone   string `json:"standalone,omitempty"`
+	Root         string `json:"root,omitempty"`
+	DefaultImage string `json:"defaultImage,omitempty"`
+	ErrorImage   string `json:"errorImage,omitempty"`
+	MagicDNS     string `json:"magicDNS,omitempty"`
+	DNSField     string `json:"dnsField,omitempty"`
+	MaxSize      string `json:"maxSize,omitempty"`
+	Workers      int    `json:"workers,omitempty"`
+	Pool         int    `json:"pool,omitempty"`
+	Platform     string `json:"platform,omitempty"`
+	SPA          bool   `json:"spa,omitempty"`
+
+	DNS                DNSConfig                `json:"dns,omitempty"`
+	DomainVerification DomainVerificationConfig `json:"domainVerification,omitempty"`
+	Store              StoreConfig              `json:"store,omitempty"`
+	Resolve            ResolveConfig            `json:"resolve,omitempty"`
+	Wait               WaitConfig               `json:"wait,omitempty"`
+	Registries         RegistriesConfig         `json:"registries,omitempty"`
+
+	Labels     []string          `json:"labels,omitempty"`
+	Routes     []Route           `json:"routes,omitempty"`
+	Whitelist  []string          `json:"whitelist,omitempty"`
+	Policy     *Policy           `json:"policy,omitempty"`
+	PolicyFile string            `json:"policyFile,omitempty"`
+	Signatures []SignatureConfig `json:"signatures,omitempty"`
+	Denylist   string            `json:"denylist,omitempty"`
+	AdminToken Secret            `json:"adminToken,omitempty"`
+}
+
+// DNSConfig configures the lookups of TXT records
+type DNSConfig struct {
+	Resolver string `json:"resolver,omitempty"`
+	MinTTL   string `json:"minTTL,omitempty"`
+	MaxTTL   string `json:"maxTTL,omitempty"`
+}
+
+// DomainVerificationConfig configures the verification
+// of the domains bound to images by TXT records
+type DomainVerificationConfig struct {
+	Enabled bool   `json:"enabled,omitempty"`
+	Secret  Secret `json:"secret,omitempty"`
+}
+
+// StoreConfig configures the cache store
+type StoreConfig struct {
+	Dir     string `json:"dir,omitempty"`
+	MaxSize string `json:"maxSize,omitempty"`
+	MaxAge  string `json:"maxAge,omitempty"`
+	Cleanup string `json:"cleanup,omitempty"`
+}
+
+// ResolveConfig configures the cache of image references resolutions
+type ResolveConfig struct {
+	TTL                  string `json:"ttl,omitempty"`
+	NegativeTTL          string `json:"negativeTTL,omitempty"`
+	StaleWhileRevalidate bool   `json:"staleWhileRevalidate,omitempty"`
+}
+
+// WaitConfig configures how requests wait for images being downloaded
+type WaitConfig struct {
+	Default        string `json:"default,omitempty"`
+	Max            string `json:"max,omitempty"`
+	RetryAfter     string `json:"retryAfter,omitempty"`
+	ProcessingPage string `json:"processingPage,omitempty"`
+}
+
+// RegistriesConfig configures the authentication against registries
+type RegistriesConfig struct {
+	Credentials     Credentials `json:"credentials,omitempty"`
+	CredentialsFile string      `json:"credentialsFile,omitempty"`
+	DockerConfig    string      `json:"dockerConfig,omitempty"`
+	Keychain        bool        `json:"keychain,omitempty"`
+}
+
+// SignatureConfig requires the images matching Pattern
+// to be signed by one of Keys
+type SignatureConfig struct {
+	Pattern string   `json:"pattern"`
+	Keys    []string `json:"keys"`
+}
+
+// LoadConfig reads and validates a configuration file
+func LoadConfig(path string) (*Config, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(dat, c); err != nil {
+		return nil, errors.Wrapf(err, "while parsing config '%s'", path)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid config '%s'", path)
+	}
+	return c, nil
+}
+
+// configOption is an option set by a field of the configuration
+type configOption struct {
+	field string
+	opt   Options
+}
+
+// options returns the options set in the configuration. Secrets are
+// read only if resolveSecrets is set
+func (c *Config) options(resolveSecrets bool) ([]configOption, error) {
+	opts := []configOption{}
+	add := func(set bool, field string, o Options) {
+		if set {
+			opts = append(opts, configOption{field: field, opt: o})
+		}
+	}
+
+	add(c.Address != "", "address", WithListeningAddress(c.Address))
+	add(c.Standalone != "", "standalone", Standalone(c.Standalone))
+	add(c.Root != "", "root", WithRoot(c.Root))
+	add(c.DefaultImage != "", "defaultImage", WithDefaultImage(c.DefaultImage))
+	add(c.ErrorImage != "", "errorImage", WithErrorImage(c.ErrorImage))
+	add(c.MagicDNS != "", "magicDNS", WithMagicDNS(c.MagicDNS))
+	add(c.DNSField != "", "dnsField", WithDNSField(c.DNSField))
+	add(c.MaxSize != "", "maxSize", WithMaxSize(c.MaxSize))
+	add(c.Workers != 0, "workers", WithWorkers(c.Workers))
+	add(c.Pool != 0, "pool", WithPoolSize(c.Pool))
+	add(c.Platform != "", "platform", WithPlatform(c.Platform))
+	add(c.SPA, "spa", WithSPA(true))
+
+	add(c.DNS.Resolver != "", "dns.resolver", WithDNSResolver(c.DNS.Resolver))
+	add(c.DNS.MinTTL != "", "dns.minTTL", WithDNSMinTTL(c.DNS.MinTTL))
+	add(c.DNS.MaxTTL != "", "dns.maxTTL", WithDNSMaxTTL(c.DNS.MaxTTL))
+
+	add(c.DomainVerification.Enabled, "domainVerification.enabled", WithDomainVerification(true))
+
+	add(c.Store.Dir != "", "store.dir", WithCacheStore(c.Store.Dir))
+	add(c.Store.MaxSize != "", "store.maxSize", WithStoreMaxSize(c.Store.MaxSize))
+	add(c.Store.MaxAge != "", "store.maxAge", WithStoreMaxAge(c.Store.MaxAge))
+	add(c.Store.Cleanup != "", "store.cleanup", WithCleanupInterval(c.Store.Cleanup))
+
+	add(c.Resolve.TTL != "", "resolve.ttl", WithResolveCacheTTL(c.Resolve.TTL))
+	add(c.Resolve.NegativeTTL != "", "resolve.negativeTTL", WithNegativeCacheTTL(c.Resolve.NegativeTTL))
+	add(c.Resolve.StaleWhileRevalidate, "resolve.staleWhileRevalidate", WithStaleWhileRevalidate(true))
+
+	add(c.Wait.Default != "", "wait.default", WithWait(c.Wait.Default))
+	add(c.Wait.Max != "", "wait.max", WithMaxWait(c.Wait.Max))
+	add(c.Wait.RetryAfter != "", "wait.retryAfter", WithRetryAfter(c.Wait.RetryAfter))
+	add(c.Wait.ProcessingPage != "", "wait.processingPage", WithProcessingPage(c.Wait.ProcessingPage))
+
+	add(len(c.Registries.Credentials) > 0, "registries.credentials", WithCredentials(c.Registries.Credentials))
+	add(c.Registries.CredentialsFile != "", "registries.credentialsFile", WithCredentialsFile(c.Registries.CredentialsFile))
+	add(c.Registries.DockerConfig != "", "registries.dockerConfig", WithDockerConfig(c.Registries.DockerConfig))
+	add(c.Registries.Keychain, "registries.keychain", WithDefaultKeychain(true))
+
+	add(len(c.Labels) > 0, "labels", WithLabels(c.Labels...))
+	add(len(c.Routes) > 0, "routes", WithRoutes(c.Routes...))
+	add(len(c.Whitelist) > 0, "whitelist", WithWhitelist(c.Whitelist...))
+	add(c.Policy != nil, "policy", WithPolicy(c.Policy))
+	add(c.PolicyFile != "", "policyFile", WithPolicyFile(c.PolicyFile))
+	for _, s := range c.Signatures {
+		add(true, "signatures", WithSignatureVerification(s.Pattern, s.Keys...))
+	}
+	add(c.Denylist != "", "denylist", WithDenylistFile(c.Denylist))
+
+	if resolveSecrets && c.AdminToken != (Secret{}) {
+		token, err := c.AdminToken.Get()
+		if err != nil {
+			return nil, errors.Wrap(err, "adminToken")
+		}
+		add(true, "adminToken", WithAdminToken(token))
+	}
+	if resolveSecrets && c.DomainVerification.Secret != (Secret{}) {
+		secret, err := c.DomainVerification.Secret.Get()
+		if err != nil {
+			return nil, errors.Wrap(err, "domainVerification.secret")
+		}
+		add(true, "domainVerification.secret", WithDomainSecret(secret))
+	}
+	return opts, nil
+}
+
+// Options returns the options set in the configuration
+func (c *Config) Options() ([]Options, error) {
+	opts, err := c.options(true)
+	if err != nil {
+		return nil, err
+	}
+	res := []Options{}
+	for _, o := range opts {
+		res = append(res, o.opt)
+	}
+	return res, nil
+}
+
+// Validate checks the configuration values, without reading the
+// files and secrets it refers to
+func (c *Config) Validate() error {
+	if c.Policy != nil && c.PolicyFile != "" {
+		return errors.New("only one of policy and policyFile can be set")
+	}
+	for i, s := range c.Signatures {
+		if _, err := regexp.Compile(s.Pattern); err != nil {
+			return errors.Wrapf(err, "signatures[%d].pattern", i)
+		}
+		if len(s.Keys) == 0 {
+			return errors.Errorf("signatures[%d].keys: at least one key is required", i)
+		}
+	}
+	for i, w := range c.Whitelist {
+		if _, err := regexp.Compile(w); err != nil {
+			return errors.Wrapf(err, "whitelist[%d]", i)
+		}
+	}
+
+	opts, err := c.options(false)
+	if err != nil {
+		return err
+	}
+	a := &API{}
+	for _, o := range opts {
+		if err := o.opt(a); err != nil {
+			return errors.Wrap(err, o.field)
+		}
+	}
+	return nil
+}
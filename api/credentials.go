@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/moby/moby/api/types"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// Secret is a value which can be given inline, read from
+// a file or from an environment variable
+type Secret struct {
+	Value string `json:"value,omitempty"`
+	File  string `json:"file,omitempty"`
+	Env   string `json:"env,omitempty"`
+}
+
+// UnmarshalJSON allows secrets to be given as plain strings
+func (s *Secret) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err == nil {
+		s.Value = v
+		return nil
+	}
+	type secret Secret
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	return d.Decode((*secret)(s))
+}
+
+// Get returns the secret value
+func (s Secret) Get() (string, error) {
+	switch {
+	case s.File != "":
+		dat, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return "", errors.Wrap(err, "while reading secret")
+		}
+		return strings.TrimSpace(string(dat)), nil
+	case s.Env != "":
+		v, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", errors.Errorf("environment variable '%s' not set", s.Env)
+		}
+		return v, nil
+	}
+	return s.Value, nil
+}
+
+// Credential is the authentication used for a registry
+type Credential struct {
+	Username Secret `json:"username,omitempty"`
+	Password Secret `json:"password,omitempty"`
+	Token    Secret `json:"token,omitempty"`
+}
+
+func (c Credential) authConfig() (*types.AuthConfig, error) {
+	username, err := c.Username.Get()
+	if err != nil {
+		return nil, errors.Wrap(err, "username")
+	}
+	password, err := c.Password.Get()
+	if err != nil {
+		return nil, errors.Wrap(err, "password")
+	}
+	token, err := c.Token.Get()
+	if err != nil {
+		return nil, errors.Wrap(err, "token")
+	}
+	return &types.AuthConfig{Username: username, Password: password, RegistryToken: token}, nil
+}
+
+// Credentials maps a registry host, optionally followed by a repository
+// prefix (e.g. ghcr.io or ghcr.io/org), to the credential to use for it
+type Credentials map[string]Credential
+
+// LoadCredentials reads credentials from a YAML or JSON file
+func LoadCredentials(path string) (Credentials, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := Credentials{}
+	if err := yaml.UnmarshalStrict(dat, &c); err != nil {
+		return nil, errors.Wrapf(err, "while parsing credentials '%s'", path)
+	}
+	return c, c.Validate()
+}
+
+// Validate checks that all the credentials keys are valid
+func (c Credentials) Validate() error {
+	for k := range c {
+		if _, _, err := credentialKey(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// credentialKey splits a credentials key in its registry, normalized
+// as in references, and repository prefix
+func credentialKey(k string) (string, string, error) {
+	parts := strings.SplitN(strings.Trim(k, "/"), "/", 2)
+	r, err := name.NewRegistry(parts[0])
+	if err != nil {
+		return "", "", errors.Wrapf(err, "invalid credentials key '%s'", k)
+	}
+	if len(parts) == 1 {
+		return r.RegistryStr(), "", nil
+	}
+	return r.RegistryStr(), parts[1], nil
+}
+
+// lookup returns the credential with the longest key matching target
+func (c Credentials) lookup(target authn.Resource) (Credential, string, bool) {
+	var match, matchPrefix string
+	var found Credential
+	ok := false
+	for k, cred := range c {
+		registry, prefix, err := credentialKey(k)
+		if err != nil || registry != target.RegistryStr() {
+			continue
+		}
+		if prefix != "" {
+			repo := strings.TrimPrefix(strings.TrimPrefix(target.String(), target.RegistryStr()), "/")
+			if repo != prefix && !strings.HasPrefix(repo, prefix+"/") {
+				continue
+			}
+		}
+		if !ok || len(prefix) > len(matchPrefix) {
+			match, matchPrefix, found, ok = k, prefix, cred, true
+		}
+	}
+	return found, match, ok
+}
+
+// Resolve implements authn.Keychain, resolving the credential
+// for each target with the secrets current values
+func (c Credentials) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	cred, key, ok := c.lookup(target)
+	if !ok {
+		return authn.Anonymous, nil
+	}
+	auth, err := cred.authConfig()
+	if err != nil {
+		return nil, errors.Wrapf(err, "while reading credentials for '%s'", key)
+	}
+	return staticAuth{auth}, nil
+}
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/labstack/echo/v4"
+	"github.com/mudler/containerbay/store"
+	"github.com/pkg/errors"
+	"github.com/pterm/pterm"
+)
+
+const denylistFile = ".denylist.json"
+
+// DenyEntry blocks either an image reference, a whole repository if
+// the reference has no tag or digest, or a manifest or layer digest
+type DenyEntry struct {
+	Reference string    `json:"reference,omitempty"`
+	Digest    string    `json:"digest,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// normalize validates e and normalizes its reference or digest,
+// so that equivalent entries compare equal
+func (e DenyEntry) normalize() (DenyEntry, error) {
+	switch {
+	case e.Reference != "" && e.Digest != "":
+		return e, errors.New("only one of reference and digest can be set")
+	case e.Reference != "":
+		if repo, err := name.NewRepository(e.Reference); err == nil {
+			e.Reference = repo.Name()
+			return e, nil
+		}
+		ref, err := name.ParseReference(e.Reference)
+		if err != nil {
+			return e, errors.Wrapf(err, "invalid reference '%s'", e.Reference)
+		}
+		e.Reference = ref.Name()
+	case e.Digest != "":
+		h, err := v1.NewHash(e.Digest)
+		if err != nil {
+			return e, errors.Wrapf(err, "invalid digest '%s'", e.Digest)
+		}
+		e.Digest = h.String()
+	default:
+		return e, errors.New("either reference or digest must be set")
+	}
+	return e, nil
+}
+
+// denylist holds the blocked references and digests,
+// persisted as JSON in its file
+type denylist struct {
+	sync.RWMutex
+	file    string
+	entries []DenyEntry
+}
+
+func (d *denylist) load() error {
+	dat, err := ioutil.ReadFile(d.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := []DenyEntry{}
+	if err := json.Unmarshal(dat, &entries); err != nil {
+		return errors.Wrapf(err, "while parsing denylist '%s'", d.file)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.entries = entries
+	return nil
+}
+
+// save writes the entries to the denylist file, replacing it atomically
+func (d *denylist) save() error {
+	dat, err := json.MarshalIndent(d.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(d.file), filepath.Base(d.file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(dat); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.file)
+}
+
+func (d *denylist) list() []DenyEntry {
+	d.RLock()
+	defer d.RUnlock()
+	return append([]DenyEntry{}, d.entries...)
+}
+
+// add blocks the normalized entry e, replacing a previous entry for
+// the same reference or digest
+func (d *denylist) add(e DenyEntry) error {
+	d.Lock()
+	defer d.Unlock()
+
+	entries := []DenyEntry{}
+	for _, old := range d.entries {
+		if old.Reference != e.Reference || old.Digest != e.Digest {
+			entries = append(entries, old)
+		}
+	}
+	d.entries = append(entries, e)
+	return d.save()
+}
+
+// remove unblocks the normalized entry e, returning
+// false if it wasn't blocked
+func (d *denylist) remove(e DenyEntry) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	entries := []DenyEntry{}
+	for _, old := range d.entries {
+		if old.Reference != e.Reference || old.Digest != e.Digest {
+			entries = append(entries, old)
+		}
+	}
+	if len(entries) == len(d.entries) {
+		return false, nil
+	}
+	d.entries = entries
+	return true, d.save()
+}
+
+// blockedReference returns the entry blocking ref, if any
+func (d *denylist) blockedReference(ref name.Reference) (DenyEntry, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	for _, e := range d.entries {
+		if e.Reference != "" && (e.Reference == ref.Name() || e.Reference == ref.Context().Name()) {
+			return e, true
+		}
+	}
+	return DenyEntry{}, false
+}
+
+// blockedDigest returns the entry blocking any of digests, if any
+func (d *denylist) blockedDigest(digests ...string) (DenyEntry, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	for _, e := range d.entries {
+		if e.Digest == "" {
+			continue
+		}
+		for _, digest := range digests {
+			if e.Digest == digest {
+				return e, true
+			}
+		}
+	}
+	return DenyEntry{}, false
+}
+
+// blocks returns true if the store entry e is blocked,
+// by its reference or any of its digests
+func (d *denylist) blocks(e store.Entry) bool {
+	if ref, err := name.ParseReference(e.Reference); err == nil {
+		if _, ok := d.blockedReference(ref); ok {
+			return true
+		}
+	}
+	_, ok := d.blockedDigest(append([]string{e.Digest, e.Index}, e.Layers...)...)
+	return ok
+}
+
+// adminAuth requires the admin token as bearer token
+func (a *API) adminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) != 1 {
+			return retErrorCode(c, http.StatusUnauthorized, "unauthorized")
+		}
+		return next(c)
+	}
+}
+
+func (a *API) listDenylist(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.denylist.list())
+}
+
+type denyResult struct {
+	Entry DenyEntry `json:"entry"`
+	// Purged are the store keys removed because blocked
+	Purged []string `json:"purged"`
+}
+
+// addDenylist blocks the entry in the request body and
+// purges the content it blocks from the store
+func (a *API) addDenylist(c echo.Context) error {
+	e := DenyEntry{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&e); err != nil {
+		return retErrorCode(c, http.StatusBadRequest, "while parsing denylist entry: %s", err.Error())
+	}
+	e, err := e.normalize()
+	if err != nil {
+		return retErrorCode(c, http.StatusBadRequest, "invalid denylist entry: %s", err.Error())
+	}
+	e.Created = time.Now()
+
+	if err := a.denylist.add(e); err != nil {
+		return retError(c, "while saving the denylist: %s", err.Error())
+	}
+	pterm.Warning.Printfln("Blocked '%s%s': %s", e.Reference, e.Digest, e.Reason)
+
+	purged, err := a.cacheStore.RemoveWhere(a.denylist.blocks)
+	for _, key := range purged {
+		pterm.Warning.Printfln("Purged blocked '%s' from the store", key)
+	}
+	if err != nil {
+		return retError(c, "while purging the store: %s", err.Error())
+	}
+	return c.JSON(http.StatusCreated, denyResult{Entry: e, Purged: purged})
+}
+
+// removeDenylist unblocks the reference or digest given as query parameter
+func (a *API) removeDenylist(c echo.Context) error {
+	e, err := DenyEntry{Reference: c.QueryParam("reference"), Digest: c.QueryParam("digest")}.normalize()
+	if err != nil {
+		return retErrorCode(c, http.StatusBadRequest, "invalid denylist entry: %s", err.Error())
+	}
+	ok, err := a.denylist.remove(e)
+	if err != nil {
+		return retError(c, "while saving the denylist: %s", err.Error())
+	}
+	if !ok {
+		return retErrorCode(c, http.StatusNotFound, "'%s%s' is not blocked", e.Reference, e.Digest)
+	}
+	pterm.Info.Printfln("Unblocked '%s%s'", e.Reference, e.Digest)
+	return c.NoContent(http.StatusNoContent)
+}
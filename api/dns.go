@@ -0,0 +1,286 @@
+package api
+
+import (
+	"bufio"
+	"encoding/binary"
+	"expvar"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultDNSServer  = "127.0.0.1:53"
+	defaultDNSTimeout = 5 * time.Second
+	defaultDNSMinTTL  = time.Minute
+	defaultDNSMaxTTL  = time.Hour
+)
+
+var (
+	errNXDomain = errors.New("no such domain")
+	errNoTXT    = errors.New("no TXT records")
+)
+
+var (
+	metrics    = expvar.NewMap("containerbay")
+	dnsMetrics = new(expvar.Map).Init()
+)
+
+func init() {
+	metrics.Set("dns", dnsMetrics)
+}
+
+// getMetrics returns the metrics of the instance as JSON
+func (a *API) getMetrics(c echo.Context) error {
+	return c.JSONBlob(http.StatusOK, []byte(metrics.String()))
+}
+
+// txtResult is the outcome of a TXT lookup
+type txtResult struct {
+	records []string
+	err     error
+	expires time.Time
+}
+
+// txtResolver looks up TXT records against a DNS server, caching the
+// results for their TTL, clamped between minTTL and maxTTL. Missing
+// domains and records are cached as well, other failures are not. Only
+// the most recently used domains are kept, as they come from clients
+type txtResolver struct {
+	sync.Mutex
+	server         string
+	minTTL, maxTTL time.Duration
+	timeout        time.Duration
+
+	cache lruCache
+	group singleflight.Group
+}
+
+// systemDNSServer returns the first nameserver of /etc/resolv.conf
+func systemDNSServer() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return defaultDNSServer
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return defaultDNSServer
+}
+
+func (r *txtResolver) clamp(ttl time.Duration) time.Duration {
+	if ttl < r.minTTL {
+		return r.minTTL
+	}
+	if r.maxTTL != 0 && ttl > r.maxTTL {
+		return r.maxTTL
+	}
+	return ttl
+}
+
+// lookup returns the TXT records of domain
+func (r *txtResolver) lookup(domain string) ([]string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	r.Lock()
+	v, ok := r.cache.get(domain)
+	r.Unlock()
+	if cached, _ := v.(*txtResult); ok && time.Now().Before(cached.expires) {
+		dnsMetrics.Add("cache_hits", 1)
+		return cached.records, cached.err
+	}
+
+	v, _, _ = r.group.Do(domain, func() (interface{}, error) {
+		start := time.Now()
+		records, ttl, err := r.query(domain)
+		dnsMetrics.Add("lookups", 1)
+		dnsMetrics.AddFloat("latency_seconds_total", time.Since(start).Seconds())
+
+		res := &txtResult{records: records, err: err}
+		switch err {
+		case nil, errNoTXT, errNXDomain:
+			if err != nil {
+				dnsMetrics.Add("not_found", 1)
+			}
+			res.expires = time.Now().Add(r.clamp(ttl))
+			r.Lock()
+			r.cache.set(domain, res)
+			r.Unlock()
+		default:
+			dnsMetrics.Add("failures", 1)
+		}
+		return res, nil
+	})
+	res := v.(*txtResult)
+	return res.records, res.err
+}
+
+// query asks the server for the TXT records of domain. For missing domains
+// or records, ttl is the negative caching TTL advertised by the zone
+func (r *txtResolver) query(domain string) (records []string, ttl time.Duration, err error) {
+	n, err := dnsmessage.NewName(domain + ".")
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "invalid domain '%s'", domain)
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: n, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := r.exchange("udp", packed)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Retry over TCP if the answer doesn't fit in a datagram
+	if h.Truncated {
+		if resp, err = r.exchange("tcp", packed); err != nil {
+			return nil, 0, err
+		}
+		if h, err = p.Start(resp); err != nil {
+			return nil, 0, err
+		}
+	}
+	if h.ID != id {
+		return nil, 0, errors.New("mismatched DNS response id")
+	}
+
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, negativeTTL(&p), errNXDomain
+	default:
+		return nil, 0, errors.Errorf("DNS lookup of '%s' failed: %s", domain, h.RCode)
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if ah.Type != dnsmessage.TypeTXT {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		txt, err := p.TXTResource()
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, strings.Join(txt.TXT, ""))
+		if recordTTL := time.Duration(ah.TTL) * time.Second; ttl == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+
+	if len(records) == 0 {
+		return nil, negativeTTL(&p), errNoTXT
+	}
+	return records, ttl, nil
+}
+
+// negativeTTL returns the TTL of negative answers from the SOA
+// record in the authority section, as in RFC 2308
+func negativeTTL(p *dnsmessage.Parser) time.Duration {
+	if err := p.SkipAllQuestions(); err != nil && err != dnsmessage.ErrSectionDone {
+		return 0
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return 0
+	}
+	for {
+		h, err := p.AuthorityHeader()
+		if err != nil {
+			return 0
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return 0
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return 0
+		}
+		ttl := h.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		return time.Duration(ttl) * time.Second
+	}
+}
+
+// exchange sends a packed query to the server over network
+// and returns the packed response
+func (r *txtResolver) exchange(network string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, r.server, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	// Over TCP messages are prefixed by their length
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// txtStub is a DNS server over UDP answering TXT queries from records
+// with ttl. Names not in records are missing, except fail.test. which
+// fails. It counts the queries for each name
+type txtStub struct {
+	sync.Mutex
+	records map[string][]string
+	ttl     uint32
+	queries map[string]int
+}
+
+func (s *txtStub) start(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	s.queries = map[string]int{}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var m dnsmessage.Message
+			if err := m.Unpack(buf[:n]); err != nil || len(m.Questions) != 1 {
+				continue
+			}
+			resp := s.answer(m)
+			out, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(out, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func (s *txtStub) answer(m dnsmessage.Message) dnsmessage.Message {
+	q := m.Questions[0]
+	s.Lock()
+	s.queries[q.Name.String()]++
+	s.Unlock()
+
+	resp := dnsmessage.Message{Header: dnsmessage.Header{ID: m.ID, Response: true}, Questions: m.Questions}
+	txt, ok := s.records[q.Name.String()]
+	switch {
+	case q.Name.String() == "fail.test.":
+		resp.RCode = dnsmessage.RCodeServerFailure
+	case !ok:
+		resp.RCode = dnsmessage.RCodeNameError
+		resp.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("test."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.test."), MBox: dnsmessage.MustNewName("root.test."), MinTTL: 30},
+		}}
+	default:
+		for _, r := range txt {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: s.ttl},
+				Body:   &dnsmessage.TXTResource{TXT: []string{r}},
+			})
+		}
+	}
+	return resp
+}
+
+func (s *txtStub) count(name string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queries[name]
+}
+
+// cachedFor returns for how long r caches the result of domain
+func cachedFor(r *txtResolver, domain string) (time.Duration, bool) {
+	r.Lock()
+	defer r.Unlock()
+	v, ok := r.cache.get(domain)
+	if !ok {
+		return 0, false
+	}
+	return time.Until(v.(*txtResult).expires), true
+}
+
+func TestTXTResolver(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ttl      uint32
+		expected time.Duration
+	}{
+		{"below the minimum TTL", 2, 10 * time.Second},
+		{"within the TTL bounds", 120, 2 * time.Minute},
+		{"above the maximum TTL", 7200, time.Hour},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stub := &txtStub{records: map[string][]string{"site.test.": {"containerbay=alpine:latest", "v=spf1 -all"}}, ttl: tc.ttl}
+			r := &txtResolver{server: stub.start(t), minTTL: 10 * time.Second, maxTTL: time.Hour, timeout: time.Second}
+
+			for i := 0; i < 2; i++ {
+				records, err := r.lookup("Site.test.")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(records, []string{"containerbay=alpine:latest", "v=spf1 -all"}) {
+					t.Fatalf("unexpected records %v", records)
+				}
+			}
+			if n := stub.count("site.test."); n != 1 {
+				t.Errorf("expected 1 query, got %d", n)
+			}
+			if d, ok := cachedFor(r, "site.test"); !ok || d > tc.expected || d < tc.expected-5*time.Second {
+				t.Errorf("expected the records to be cached for %s, got %s", tc.expected, d)
+			}
+		})
+	}
+}
+
+func TestTXTResolverFailures(t *testing.T) {
+	stub := &txtStub{}
+	r := &txtResolver{server: stub.start(t), minTTL: time.Second, maxTTL: time.Hour, timeout: time.Second}
+
+	// Missing domains are cached for the negative TTL of the zone
+	for i := 0; i < 2; i++ {
+		if _, err := r.lookup("missing.test"); err != errNXDomain {
+			t.Fatalf("expected errNXDomain, got %v", err)
+		}
+	}
+	if n := stub.count("missing.test."); n != 1 {
+		t.Errorf("expected 1 query for the missing domain, got %d", n)
+	}
+	if d, ok := cachedFor(r, "missing.test"); !ok || d > 30*time.Second || d < 25*time.Second {
+		t.Errorf("expected the missing domain to be cached for the SOA minimum TTL, got %s", d)
+	}
+
+	// Server failures are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := r.lookup("fail.test"); err == nil || err == errNXDomain || err == errNoTXT {
+			t.Fatalf("expected a server failure, got %v", err)
+		}
+	}
+	if n := stub.count("fail.test."); n != 2 {
+		t.Errorf("expected 2 queries for the failing domain, got %d", n)
+	}
+	if _, ok := cachedFor(r, "fail.test"); ok {
+		t.Error("expected the failure not to be cached")
+	}
+}
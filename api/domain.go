@@ -0,0 +1,192 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/pterm/pterm"
+)
+
+// domainRecordVersion is the version of the TXT record format, set
+// in the record as v=<key><version>, e.g. v=containerbay1
+const domainRecordVersion = "1"
+
+// domainsLabel is the image label listing the domains
+// allowed to bind the image, when verification is enabled
+const domainsLabel = "io.containerbay.domains"
+
+// domainRecord is the site a domain is bound to by a TXT record
+type domainRecord struct {
+	image    string
+	platform *v1.Platform
+	// root is the directory of the image served as web root
+	root string
+	spa  bool
+	// token is the domain ownership verification token
+	token string
+
+	// domain is the domain the record is for, set if it is
+	// not verified by its token and has to be by the image label
+	domain string
+}
+
+// site returns how to serve the record
+func (r *domainRecord) site() site {
+	return site{image: r.image, platform: r.platform, root: r.root, spa: r.spa, domain: r.domain}
+}
+
+// DomainToken returns the token a TXT record needs to bind domain
+// to the repository of image, when domains are verified with secret
+func DomainToken(secret, domain, image string) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid image '%s'", image)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(normalizeHost(domain) + " " + ref.Context().Name()))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyToken returns true if the token of r binds domain to its image
+func (a *API) verifyToken(r *domainRecord, domain string) bool {
+	if a.domainSecret == "" || r.token == "" {
+		return false
+	}
+	token, err := DomainToken(a.domainSecret, domain, r.image)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(r.token))
+}
+
+// domainAllowed returns true if domain is in the comma or space separated
+// list of the domains label. Entries can be wildcards, e.g. *.example.com
+func domainAllowed(labels map[string]string, domain string) bool {
+	domain = normalizeHost(domain)
+	for _, d := range strings.FieldsFunc(labels[domainsLabel], func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		d = normalizeHost(d)
+		if d == domain || (strings.HasPrefix(d, "*.") && strings.HasSuffix(domain, d[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDomainRecord parses a TXT record for key, returning false if
+// the record is not for us. The record is either the legacy one,
+// e.g.:
+//
+//	containerbay=library/alpine:latest
+//
+// or the versioned one, with fields separated by spaces or semicolons:
+//
+//	v=containerbay1; image=ghcr.io/ourorg/site:latest; root=/public; platform=linux/arm64; spa=true; token=...
+//
+// Unknown fields of the versioned record are ignored
+func parseDomainRecord(key, txt string) (*domainRecord, bool, error) {
+	fields := strings.FieldsFunc(txt, func(r rune) bool {
+		return r == ';' || r == ' ' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return nil, false, nil
+	}
+
+	version := "v=" + key
+	switch {
+	case strings.HasPrefix(fields[0], key+"="):
+		return &domainRecord{image: strings.TrimPrefix(fields[0], key+"=")}, true, nil
+	case fields[0] == version+domainRecordVersion:
+	case strings.HasPrefix(fields[0], version):
+		return nil, true, errors.Errorf("unsupported record version '%s'", strings.TrimPrefix(fields[0], "v="))
+	default:
+		return nil, false, nil
+	}
+
+	r := &domainRecord{}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, true, errors.Errorf("invalid field '%s', expected key=value", f)
+		}
+		k, v := strings.ToLower(kv[0]), kv[1]
+		switch k {
+		case "image":
+			r.image = v
+		case "root":
+			r.root = path.Clean("/" + v)
+		case "platform":
+			p, err := parsePlatform(v)
+			if err != nil {
+				return nil, true, err
+			}
+			r.platform = p
+		case "spa":
+			spa, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, true, errors.Errorf("invalid spa value '%s'", v)
+			}
+			r.spa = spa
+		case "token":
+			r.token = v
+		default:
+			pterm.Debug.Printfln("(magicDNS) ignoring unknown TXT record field '%s'", k)
+		}
+	}
+
+	if r.image == "" {
+		return nil, true, errors.New("image is required")
+	}
+	if _, err := name.ParseReference(r.image); err != nil {
+		return nil, true, errors.Wrapf(err, "invalid image '%s'", r.image)
+	}
+	return r, true, nil
+}
+
+// containerFromDomain returns the site domain is bound to by its TXT
+// records, the first valid one wins. With domain verification, records
+// without a valid token are bound only if the image label allows domain
+func (a *API) containerFromDomain(domain string) (*domainRecord, error) {
+	domain = normalizeHost(domain)
+
+	pterm.Debug.Printfln("(magicDNS) Querying TXT records for domain '%s'", domain)
+
+	txtrecords, err := a.dns.lookup(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	pterm.Debug.Printfln("(magicDNS) Found '%v' for domain '%s'", txtrecords, domain)
+
+	var invalid error
+	for _, txt := range txtrecords {
+		pterm.Debug.Printfln("(magicDNS) txt record '%v' for domain '%s'", txt, domain)
+
+		r, ok, err := parseDomainRecord(a.dnsTXTKey, txt)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			pterm.Warning.Printfln("Invalid TXT record '%s' for domain '%s': %s", txt, domain, err.Error())
+			invalid = errors.Wrapf(err, "invalid TXT record '%s'", txt)
+			continue
+		}
+		if a.domainVerification && !a.verifyToken(r, domain) {
+			pterm.Debug.Printfln("(magicDNS) no valid token for domain '%s', the image has to allow it", domain)
+			r.domain = domain
+		}
+		return r, nil
+	}
+	if invalid != nil {
+		return nil, invalid
+	}
+	return nil, errors.New("record not found")
+}
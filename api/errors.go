@@ -0,0 +1,173 @@
+package api
+
+import (
+	"archive/tar"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// maxErrorPageSize is the max size of the error pages read from the error image
+const maxErrorPageSize = 1 << 20
+
+const defaultErrorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Code}} {{.Status}}</title>
+</head>
+<body>
+<h1>{{.Code}} {{.Status}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`
+
+var (
+	errorTmpl = template.Must(template.New("error").Parse(defaultErrorPage))
+
+	// errorPageName matches the error pages, e.g. 404.html or 50x.html
+	errorPageName = regexp.MustCompile(`^/([1-5][0-9][0-9x])\.html$`)
+)
+
+// httpError is an error replied with its status code
+type httpError struct {
+	code    int
+	message string
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+func newHTTPError(code int, template string, i ...interface{}) *httpError {
+	return &httpError{code: code, message: fmt.Sprintf(template, i...)}
+}
+
+// registryError maps err, from a registry, to its status. Missing
+// images are not found, the registry rate limiting us is unavailable
+// and any other failure a bad gateway
+func registryError(err error, template string, i ...interface{}) *httpError {
+	msg := fmt.Sprintf(template, i...) + ": " + err.Error()
+
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return &httpError{code: http.StatusBadGateway, message: msg}
+	}
+	switch terr.StatusCode {
+	// Registries deny access to missing repositories, not to leak them
+	case http.StatusNotFound, http.StatusUnauthorized, http.StatusForbidden:
+		return &httpError{code: http.StatusNotFound, message: msg}
+	case http.StatusTooManyRequests:
+		return &httpError{code: http.StatusServiceUnavailable, message: msg}
+	}
+	return &httpError{code: http.StatusBadGateway, message: msg}
+}
+
+// errorPageNames returns the pages for code, the specific one first
+func errorPageNames(code int) []string {
+	return []string{fmt.Sprintf("/%d.html", code), fmt.Sprintf("/%dx.html", code/10)}
+}
+
+// wantsHTML returns true if the client accepts HTML, like browsers
+func wantsHTML(c echo.Context) bool {
+	return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML)
+}
+
+type errorPage struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+// renderError replies with err, as JSON or as HTML to browsers. The HTML
+// page for its status is looked up in pages, the image being served if
+// any, then in the error image, falling back to a default one
+func (a *API) renderError(c echo.Context, err error, pages http.FileSystem) error {
+	if c.Response().Committed {
+		return err
+	}
+	e, ok := err.(*httpError)
+	if !ok {
+		e = &httpError{code: http.StatusInternalServerError, message: err.Error()}
+	}
+
+	if !wantsHTML(c) {
+		return c.JSON(e.code, errorMessage{Error: e.message})
+	}
+
+	for _, p := range errorPageNames(e.code) {
+		if pages != nil {
+			if f, err := pages.Open(p); err == nil {
+				defer f.Close()
+				if st, err := f.Stat(); err == nil && !st.IsDir() {
+					return c.Stream(e.code, echo.MIMETextHTMLCharsetUTF8, f)
+				}
+			}
+		}
+		if dat, ok := a.errorPages[p]; ok {
+			return c.HTMLBlob(e.code, dat)
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().WriteHeader(e.code)
+	return errorTmpl.Execute(c.Response(), errorPage{Code: e.code, Status: http.StatusText(e.code), Message: e.message})
+}
+
+// loadErrorPages reads the error pages at the root of the error image
+func (a *API) loadErrorPages() error {
+	ref, err := name.ParseReference(a.errorImage)
+	if err != nil {
+		return err
+	}
+	opts := []remote.Option{}
+	if a.platform != nil {
+		opts = append(opts, remote.WithPlatform(*a.platform))
+	}
+	img, err := remote.Image(ref, a.remoteOptions(opts...)...)
+	if err != nil {
+		return err
+	}
+
+	reader := mutate.Extract(img)
+	defer reader.Close()
+
+	pages := map[string][]byte{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		p := path.Clean("/" + hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !errorPageName.MatchString(p) {
+			continue
+		}
+		if hdr.Size > maxErrorPageSize {
+			return errors.Errorf("error page '%s' exceeds %d bytes", p, maxErrorPageSize)
+		}
+		dat, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		pages[p] = dat
+	}
+	a.errorPages = pages
+	return nil
+}
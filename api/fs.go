@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"path"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+// spaFileSystem serves the index.html of the root for the missing paths
+// without an extension, which are client side routes of single page
+// applications. Missing assets are still not found
+type spaFileSystem struct {
+	http.FileSystem
+}
+
+func (fs spaFileSystem) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if os.IsNotExist(err) && path.Ext(name) == "" {
+		return fs.FileSystem.Open("/index.html")
+	}
+	return f, err
+}
+
+// rootFileSystem serves the files under its directory, resolving their
+// symlinks as if it was the root, so nothing outside of it can be served
+type rootFileSystem string
+
+func (dir rootFileSystem) Open(name string) (http.File, error) {
+	p, err := securejoin.SecureJoin(string(dir), path.Clean("/"+name))
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// imagePath is an image selected by the prefix of a request path
+type imagePath struct {
+	image    string
+	platform *v1.Platform
+	// prefix is the part of the path selecting the image and
+	// the platform, stripped from the path of the files
+	prefix string
+}
+
+// isRegistryHost returns true if s can only be a registry host,
+// as in the references of docker
+func isRegistryHost(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
+// repositoryEnd is the segment ending untagged references
+// of nested repositories, e.g. /ghcr.io/org/team/site/-/
+const repositoryEnd = "-"
+
+// referenceEnd returns the index of the last segment of the reference
+// in segments and of the one following it, -1 if there is none
+func referenceEnd(segments []string) (int, int) {
+	for i := 1; i < len(segments); i++ {
+		if segments[i] == repositoryEnd && i >= 2 {
+			return i - 1, i + 1
+		}
+		if !strings.ContainsAny(segments[i], ":@") {
+			continue
+		}
+		// Not a tag nor a digest, or a file of registry/org/container
+		if i > 2 && i == len(segments)-1 {
+			break
+		}
+		if _, err := name.ParseReference(strings.Join(segments[:i+1], "/")); err != nil {
+			break
+		}
+		return i, i + 1
+	}
+	switch {
+	case len(segments) < 2:
+		return -1, -1
+	case len(segments) == 2:
+		return 1, 2
+	// Two-part references, e.g. /docker.io/alpine/ or /registry.local:5000/x/index.html
+	case segments[2] == "", len(segments) == 3 && strings.Contains(segments[2], "."):
+		return 1, 2
+	}
+	return 2, 3
+}
+
+// parseImagePath returns the image the path starts with. The first segment
+// is the registry, and the reference ends with the segment with a tag or a
+// digest, e.g.:
+//
+//	/ghcr.io/org/team/site:v1/index.html
+//	/registry.local:5000/site@sha256:<hex>/index.html
+//
+// Without a tag or digest the reference is registry/org/container, or
+// ends before a - segment for nested repositories:
+//
+//	/ghcr.io/org/team/site/-/index.html
+//
+// The last segment of the path is a file past registry/org/container,
+// e.g. /ghcr.io/org/site/a:b.html, so tagged nested references need the
+// trailing slash. It is a file of registry/org too if it has a dot, e.g.
+// /registry.local:5000/x/index.html. The segment after the reference can select the platform.
+// It returns nil if the path doesn't start with an image
+func parseImagePath(p string) (*imagePath, error) {
+	segments := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if !isRegistryHost(segments[0]) {
+		return nil, nil
+	}
+
+	end, next := referenceEnd(segments)
+	if end == -1 {
+		return nil, nil
+	}
+	for _, s := range segments[:end+1] {
+		if s == "" {
+			return nil, nil
+		}
+	}
+
+	image := strings.Join(segments[:end+1], "/")
+	if _, err := name.ParseReference(image); err != nil {
+		return nil, nil
+	}
+
+	res := &imagePath{image: image, prefix: "/" + strings.Join(segments[:next], "/") + "/"}
+	if next < len(segments) && strings.HasPrefix(segments[next], platformPathPrefix) {
+		platform, err := parsePlatformSegment(segments[next])
+		if err != nil {
+			return nil, err
+		}
+		res.platform = platform
+		res.prefix += segments[next] + "/"
+	}
+	return res, nil
+}
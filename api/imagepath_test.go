@@ -0,0 +1,98 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseImagePath(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	for _, tc := range []struct {
+		path     string
+		image    string
+		platform string
+		prefix   string
+		err      bool
+	}{
+		// Not an image
+		{path: "/"},
+		{path: "/index.html"},
+		{path: "/org/site/index.html"},
+		{path: "/ghcr.io//site/"},
+		{path: "/ghcr.io/org//site:v1/"},
+		{path: "/static.v2//app.js"},
+		{path: "/ghcr.io/Org/site/index.html"},
+
+		{path: "/ghcr.io/org/site/", image: "ghcr.io/org/site", prefix: "/ghcr.io/org/site/"},
+		{path: "/ghcr.io/org/site", image: "ghcr.io/org/site", prefix: "/ghcr.io/org/site/"},
+		{path: "/ghcr.io/org/site/index.html", image: "ghcr.io/org/site", prefix: "/ghcr.io/org/site/"},
+		{path: "/ghcr.io/org/site:v1.2/a/b.html", image: "ghcr.io/org/site:v1.2", prefix: "/ghcr.io/org/site:v1.2/"},
+		{path: "/ghcr.io/org/site:v1", image: "ghcr.io/org/site:v1", prefix: "/ghcr.io/org/site:v1/"},
+		{path: "/localhost/org/site/", image: "localhost/org/site", prefix: "/localhost/org/site/"},
+
+		// Two-part references
+		{path: "/ghcr.io/org", image: "ghcr.io/org", prefix: "/ghcr.io/org/"},
+		{path: "/registry.local:5000/site/", image: "registry.local:5000/site", prefix: "/registry.local:5000/site/"},
+		{path: "/registry.local:5000/site/index.html", image: "registry.local:5000/site", prefix: "/registry.local:5000/site/"},
+		// Repositories are at least two characters
+		{path: "/registry.local:5000/x/"},
+		{path: "/docker.io/alpine/", image: "docker.io/alpine", prefix: "/docker.io/alpine/"},
+		{path: "/docker.io/alpine/-/etc/os-release", image: "docker.io/alpine", prefix: "/docker.io/alpine/-/"},
+		{path: "/docker.io/alpine:3.14/etc/os-release", image: "docker.io/alpine:3.14", prefix: "/docker.io/alpine:3.14/"},
+		{path: "/static.v2/js/app.js", image: "static.v2/js", prefix: "/static.v2/js/"},
+		{path: "/ghcr.io/org/my.site/", image: "ghcr.io/org/my.site", prefix: "/ghcr.io/org/my.site/"},
+
+		// Nested repositories
+		{path: "/ghcr.io/org/team/site:v1/index.html", image: "ghcr.io/org/team/site:v1", prefix: "/ghcr.io/org/team/site:v1/"},
+		{path: "/ghcr.io/org/team/site/-/index.html", image: "ghcr.io/org/team/site", prefix: "/ghcr.io/org/team/site/-/"},
+		{path: "/ghcr.io/org/team/site/-", image: "ghcr.io/org/team/site", prefix: "/ghcr.io/org/team/site/-/"},
+		{path: "/ghcr.io/org/-/index.html", image: "ghcr.io/org", prefix: "/ghcr.io/org/-/"},
+		// Without a tag nor -, the reference is registry/org/container
+		{path: "/ghcr.io/org/team/site/index.html", image: "ghcr.io/org/team", prefix: "/ghcr.io/org/team/"},
+
+		// Files with a colon
+		{path: "/ghcr.io/org/site/foo:bar.html", image: "ghcr.io/org/site", prefix: "/ghcr.io/org/site/"},
+		{path: "/ghcr.io/org/site:v1/foo:bar.html", image: "ghcr.io/org/site:v1", prefix: "/ghcr.io/org/site:v1/"},
+		{path: "/ghcr.io/org/site/dir/a:b:c/x.html", image: "ghcr.io/org/site", prefix: "/ghcr.io/org/site/"},
+		// Tagged nested references need the trailing slash
+		{path: "/ghcr.io/org/team/site:v1/", image: "ghcr.io/org/team/site:v1", prefix: "/ghcr.io/org/team/site:v1/"},
+		{path: "/ghcr.io/org/team/site:v1", image: "ghcr.io/org/team", prefix: "/ghcr.io/org/team/"},
+
+		// Digests and ports
+		{path: "/ghcr.io/org/site@" + digest + "/index.html", image: "ghcr.io/org/site@" + digest, prefix: "/ghcr.io/org/site@" + digest + "/"},
+		{path: "/ghcr.io/org/site@sha256:abc/"},
+		{path: "/registry.local:5000/site:v1/index.html", image: "registry.local:5000/site:v1", prefix: "/registry.local:5000/site:v1/"},
+		{path: "/registry.local:5000/org/site/", image: "registry.local:5000/org/site", prefix: "/registry.local:5000/org/site/"},
+
+		// Platforms
+		{path: "/ghcr.io/org/site/+linux-arm64/index.html", image: "ghcr.io/org/site", platform: "linux/arm64", prefix: "/ghcr.io/org/site/+linux-arm64/"},
+		{path: "/ghcr.io/org/team/site/-/+linux-arm-v7/", image: "ghcr.io/org/team/site", platform: "linux/arm/v7", prefix: "/ghcr.io/org/team/site/-/+linux-arm-v7/"},
+		{path: "/ghcr.io/org/site:v1/+linux/", err: true},
+	} {
+		p, err := parseImagePath(tc.path)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error %v", tc.path, err)
+			continue
+		}
+		if tc.err {
+			continue
+		}
+		if tc.image == "" {
+			if p != nil {
+				t.Errorf("%s: expected no image, got %+v", tc.path, p)
+			}
+			continue
+		}
+		if p == nil {
+			t.Errorf("%s: expected %s, got no image", tc.path, tc.image)
+			continue
+		}
+		platform := ""
+		if p.platform != nil {
+			platform = platformString(*p.platform)
+		}
+		if p.image != tc.image || p.prefix != tc.prefix || platform != tc.platform {
+			t.Errorf("%s: expected %s %s %s, got %s %s %s", tc.path, tc.image, tc.prefix, tc.platform, p.image, p.prefix, platform)
+		}
+	}
+}
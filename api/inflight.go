@@ -0,0 +1,284 @@
+package api
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// jobHistory is for how long finished downloads are reported
+const jobHistory = 10 * time.Minute
+
+// errQueueFull is the error of the downloads which couldn't
+// be queued, as the workers are busy and the pool is full
+var errQueueFull = errors.New("the download queue is full")
+
+type jobState string
+
+const (
+	jobQueued      jobState = "queued"
+	jobDownloading jobState = "downloading"
+	jobExtracting  jobState = "extracting"
+	jobReady       jobState = "ready"
+	jobFailed      jobState = "failed"
+)
+
+type layerProgress struct {
+	Digest  string `json:"digest"`
+	Size    int64  `json:"size"`
+	Fetched int64  `json:"fetched"`
+}
+
+type jobStatus struct {
+	Key      string          `json:"key"`
+	Digest   string          `json:"digest"`
+	Image    string          `json:"image"`
+	State    jobState        `json:"state"`
+	Layers   []layerProgress `json:"layers,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Queued   time.Time       `json:"queued"`
+	Started  *time.Time      `json:"started,omitempty"`
+	Finished *time.Time      `json:"finished,omitempty"`
+}
+
+// download is a download of an image in the store,
+// which requests can wait for
+type download struct {
+	key  string
+	done chan struct{}
+	err  error
+
+	mu          sync.Mutex
+	status      jobStatus
+	subscribers map[chan struct{}]bool
+}
+
+// Done returns a channel which is closed when the download completes
+func (d *download) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns the error the download failed with, if any.
+// It is meaningful only once Done is closed
+func (d *download) Err() error {
+	return d.err
+}
+
+// Status returns a snapshot of the download status
+func (d *download) Status() jobStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.status
+	s.Layers = append([]layerProgress{}, d.status.Layers...)
+	return s
+}
+
+// Subscribe returns a channel which is signaled when the status of
+// the download changes, and a function to stop the subscription
+func (d *download) Subscribe() (<-chan struct{}, func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	if d.subscribers == nil {
+		d.subscribers = make(map[chan struct{}]bool)
+	}
+	d.subscribers[ch] = true
+	return ch, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.subscribers, ch)
+	}
+}
+
+// update mutates the download status and notifies the subscribers
+func (d *download) update(f func(s *jobStatus)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f(&d.status)
+	for ch := range d.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (d *download) setState(state jobState) {
+	d.update(func(s *jobStatus) {
+		s.State = state
+		if state == jobDownloading {
+			now := time.Now()
+			s.Started = &now
+		}
+	})
+}
+
+func (d *download) setLayers(layers []layerProgress) {
+	d.update(func(s *jobStatus) {
+		s.Layers = layers
+	})
+}
+
+func (d *download) fetched(digest string, n int64) {
+	d.update(func(s *jobStatus) {
+		for i := range s.Layers {
+			if s.Layers[i].Digest == digest {
+				s.Layers[i].Fetched += n
+			}
+		}
+	})
+}
+
+// downloads keeps track of the downloads in flight, so exactly
+// one download runs for each store key
+type downloads struct {
+	sync.Mutex
+	jobs map[string]*download
+}
+
+// get returns the download in flight for key, or the last failed one
+// if it failed more recently than retention. If there is none, a new
+// download is registered and returned with true.
+func (d *downloads) get(w workPackage, retention time.Duration) (*download, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.jobs == nil {
+		d.jobs = make(map[string]*download)
+	}
+	// Failed downloads are kept for retention at least, so they aren't retried
+	if retention > jobHistory {
+		d.prune(retention)
+	} else {
+		d.prune(jobHistory)
+	}
+
+	if dl, ok := d.jobs[w.key]; ok {
+		select {
+		case <-dl.done:
+			if dl.err != nil && time.Since(*dl.status.Finished) < retention {
+				return dl, false
+			}
+		default:
+			return dl, false
+		}
+	}
+
+	dl := &download{
+		key:  w.key,
+		done: make(chan struct{}),
+		status: jobStatus{
+			Key:    w.key,
+			Digest: w.digest,
+			Image:  w.source,
+			State:  jobQueued,
+			Queued: time.Now(),
+		},
+	}
+	d.jobs[w.key] = dl
+	return dl, true
+}
+
+// lookup returns the download of key, if any
+func (d *downloads) lookup(key string) (*download, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	dl, ok := d.jobs[key]
+	return dl, ok
+}
+
+// prune forgets the downloads finished more than age ago.
+// It must be called with the lock held
+func (d *downloads) prune(age time.Duration) {
+	for key, dl := range d.jobs {
+		select {
+		case <-dl.done:
+			if time.Since(*dl.status.Finished) > age {
+				delete(d.jobs, key)
+			}
+		default:
+		}
+	}
+}
+
+// list returns the downloads in flight and the recently finished ones,
+// oldest first
+func (d *downloads) list() (res []*download) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.prune(jobHistory)
+	for _, dl := range d.jobs {
+		res = append(res, dl)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].status.Queued.Before(res[j].status.Queued)
+	})
+	return
+}
+
+// finish marks the download of key as completed with err,
+// notifying all its waiters
+func (d *downloads) finish(key string, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if dl, ok := d.jobs[key]; ok {
+		dl.complete(err)
+	}
+}
+
+// drop completes the download of key with err and forgets it,
+// so the next request for key starts a new one
+func (d *downloads) drop(key string, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if dl, ok := d.jobs[key]; ok {
+		dl.complete(err)
+		delete(d.jobs, key)
+	}
+}
+
+// complete marks the download as completed with err,
+// notifying all its waiters
+func (d *download) complete(err error) {
+	d.err = err
+	d.update(func(s *jobStatus) {
+		now := time.Now()
+		s.Finished = &now
+		s.State = jobReady
+		if err != nil {
+			s.State = jobFailed
+			s.Error = err.Error()
+		}
+	})
+	close(d.done)
+}
+
+// fetch returns the download of w, queueing it to the
+// workers if it isn't already in flight. If the queue is full
+// the download is dropped, failing with errQueueFull
+func (a *API) fetch(w workPackage) *download {
+	dl, started := a.downloads.get(w, a.resolver.negativeTTL)
+	if !started {
+		return dl
+	}
+
+	// Hold the entry while queued, so it can't be
+	// evicted before the download gets to it
+	w.release = a.cacheStore.Acquire(w.key)
+	w.progress = dl
+	select {
+	case a.pool <- w:
+	default:
+		w.release()
+		a.downloads.drop(w.key, errQueueFull)
+	}
+	return dl
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mudler/containerbay/store"
+)
+
+func TestDownloadsSingleFlight(t *testing.T) {
+	d := &downloads{}
+	dl, started := d.get(workPackage{key: "a"}, time.Minute)
+	if !started {
+		t.Fatal("expected the first download to start")
+	}
+	if other, started := d.get(workPackage{key: "a"}, time.Minute); started || other != dl {
+		t.Fatal("expected the download in flight to be shared")
+	}
+
+	d.finish("a", errors.New("failed"))
+	<-dl.Done()
+	if other, started := d.get(workPackage{key: "a"}, time.Minute); started || other != dl || other.Err() == nil {
+		t.Fatal("expected the failure to be shared during the retention")
+	}
+	if _, started := d.get(workPackage{key: "a"}, 0); !started {
+		t.Fatal("expected a new download after the retention")
+	}
+}
+
+func TestDownloadsPrune(t *testing.T) {
+	d := &downloads{}
+	old, _ := d.get(workPackage{key: "old"}, 0)
+	d.finish("old", nil)
+	d.get(workPackage{key: "running"}, 0)
+
+	// Pretend the download finished before the job history
+	finished := time.Now().Add(-2 * jobHistory)
+	old.status.Finished = &finished
+
+	d.get(workPackage{key: "new"}, 0)
+	if _, ok := d.lookup("old"); ok {
+		t.Error("expected the old download to be pruned on new downloads")
+	}
+	for _, key := range []string{"running", "new"} {
+		if _, ok := d.lookup(key); !ok {
+			t.Errorf("expected %s not to be pruned", key)
+		}
+	}
+}
+
+func TestFetchQueueFull(t *testing.T) {
+	st := store.New(t.TempDir())
+	if err := st.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	a := &API{cacheStore: st, pool: make(chan workPackage, 1)}
+	queued := a.fetch(workPackage{key: "a"})
+	select {
+	case <-queued.Done():
+		t.Fatal("expected the download to be queued")
+	default:
+	}
+
+	dropped := a.fetch(workPackage{key: "b"})
+	select {
+	case <-dropped.Done():
+	default:
+		t.Fatal("expected the download to be dropped")
+	}
+	if dropped.Err() != errQueueFull {
+		t.Fatalf("expected errQueueFull, got %v", dropped.Err())
+	}
+	if _, ok := a.downloads.lookup("b"); ok {
+		t.Fatal("expected the dropped download to be forgotten")
+	}
+
+	// The worker takes the queued download, making room for the next one
+	w := <-a.pool
+	w.release()
+	if dl := a.fetch(workPackage{key: "b"}); dl == dropped || dl.Err() != nil {
+		t.Fatal("expected a new download to be queued")
+	}
+}
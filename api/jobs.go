@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// eventsInterval is the minimum interval between two progress events
+const eventsInterval = 500 * time.Millisecond
+
+var blobRegex = regexp.MustCompile(`/blobs/(sha256:[a-f0-9]{64})$`)
+
+// progressTransport counts the bytes of the layers fetched
+// from the registry
+type progressTransport struct {
+	inner    http.RoundTripper
+	download *download
+}
+
+func (t *progressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	if digest := blobDigest(req); digest != "" {
+		resp.Body = &progressReader{ReadCloser: resp.Body, digest: digest, download: t.download}
+	}
+	return resp, err
+}
+
+// blobDigest returns the digest of the blob requested by req,
+// following back the redirects the registry might have issued
+func blobDigest(req *http.Request) string {
+	for req != nil {
+		if m := blobRegex.FindStringSubmatch(req.URL.Path); m != nil {
+			return m[1]
+		}
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+	return ""
+}
+
+type progressReader struct {
+	io.ReadCloser
+	digest   string
+	download *download
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		r.download.fetched(r.digest, int64(n))
+	}
+	return n, err
+}
+
+// jobFromParam returns the download matching the digest in the request path,
+// which can be either the store key or the image digest
+func (a *API) jobFromParam(c echo.Context) (*download, bool) {
+	digest := c.Param("digest")
+	if dl, ok := a.downloads.lookup(digest); ok {
+		return dl, true
+	}
+	for _, dl := range a.downloads.list() {
+		if dl.status.Digest == digest || strings.TrimPrefix(dl.status.Digest, "sha256:") == digest {
+			return dl, true
+		}
+	}
+	return nil, false
+}
+
+func (a *API) listJobs(c echo.Context) error {
+	res := []jobStatus{}
+	for _, dl := range a.downloads.list() {
+		res = append(res, dl.Status())
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (a *API) getJob(c echo.Context) error {
+	dl, ok := a.jobFromParam(c)
+	if !ok {
+		return c.JSON(http.StatusNotFound, errorMessage{Error: fmt.Sprintf("no job found for '%s'", c.Param("digest"))})
+	}
+	return c.JSON(http.StatusOK, dl.Status())
+}
+
+// jobEvents streams the status of a job as Server-Sent Events,
+// until the job is finished
+func (a *API) jobEvents(c echo.Context) error {
+	dl, ok := a.jobFromParam(c)
+	if !ok {
+		return c.JSON(http.StatusNotFound, errorMessage{Error: fmt.Sprintf("no job found for '%s'", c.Param("digest"))})
+	}
+
+	changes, unsubscribe := dl.Subscribe()
+	defer unsubscribe()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func() (jobStatus, error) {
+		status := dl.Status()
+		dat, err := json.Marshal(status)
+		if err != nil {
+			return status, err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", status.State, dat); err != nil {
+			return status, err
+		}
+		w.Flush()
+		return status, nil
+	}
+
+	ctx := c.Request().Context()
+	for {
+		status, err := send()
+		if err != nil {
+			return err
+		}
+		if status.State == jobReady || status.State == jobFailed {
+			return nil
+		}
+
+		select {
+		case <-changes:
+		case <-ctx.Done():
+			return nil
+		}
+
+		select {
+		case <-time.After(eventsInterval):
+		case <-dl.Done():
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
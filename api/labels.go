@@ -0,0 +1,89 @@
+package api
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// labelPrefix prefixes the image labels configuring how images are served
+const labelPrefix = "io.containerbay."
+
+// Serving configuration labels, without the prefix
+const (
+	labelRoot         = "root"
+	labelSPA          = "spa"
+	labelCacheControl = "cache-control"
+	labelCORS         = "cors"
+	labelIndex        = "index"
+)
+
+var servingLabels = []string{labelRoot, labelSPA, labelCacheControl, labelCORS, labelIndex}
+
+// honoredLabels returns the set of labels, given as a list or comma
+// separated, checking they are serving labels. All of them are honored
+// if none is given, none disables all of them
+func honoredLabels(labels []string) (map[string]bool, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	res := map[string]bool{}
+	for _, l := range splitList(strings.Join(labels, ",")) {
+		l = strings.TrimPrefix(l, labelPrefix)
+		if l == "none" {
+			continue
+		}
+		known := false
+		for _, s := range servingLabels {
+			known = known || s == l
+		}
+		if !known {
+			return nil, errors.Errorf("unknown label '%s', expected one of %v or none", l, servingLabels)
+		}
+		res[l] = true
+	}
+	return res, nil
+}
+
+// label returns the value of the serving label l, if it is honored
+func (a *API) label(labels map[string]string, l string) (string, bool) {
+	if a.labels != nil && !a.labels[l] {
+		return "", false
+	}
+	v, ok := labels[labelPrefix+l]
+	return v, ok
+}
+
+// applyLabels completes s with the serving configuration of the image
+// labels. What is set by the operator or in DNS is not overridden
+func (a *API) applyLabels(s site, labels map[string]string) site {
+	if v, ok := a.label(labels, labelRoot); ok && s.root == "" {
+		s.root = path.Clean("/" + v)
+	}
+	if v, ok := a.label(labels, labelSPA); ok && !s.spa {
+		s.spa, _ = strconv.ParseBool(v)
+	}
+	if v, ok := a.label(labels, labelCacheControl); ok {
+		s.cacheControl = v
+	}
+	if v, ok := a.label(labels, labelCORS); ok {
+		s.cors = splitList(v)
+	}
+	if v, ok := a.label(labels, labelIndex); ok {
+		s.index = splitList(v)
+	}
+	return s
+}
+
+// splitList splits a comma separated list
+func splitList(s string) []string {
+	res := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
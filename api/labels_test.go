@@ -0,0 +1,64 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHonoredLabels(t *testing.T) {
+	for _, tc := range []struct {
+		labels []string
+		want   map[string]bool
+		err    bool
+	}{
+		{labels: nil, want: nil},
+		{labels: []string{"none"}, want: map[string]bool{}},
+		{labels: []string{"root", "spa"}, want: map[string]bool{"root": true, "spa": true}},
+		{labels: []string{"root,spa"}, want: map[string]bool{"root": true, "spa": true}},
+		{labels: []string{"io.containerbay.cors, index"}, want: map[string]bool{"cors": true, "index": true}},
+		{labels: []string{"sap"}, err: true},
+		{labels: []string{"root,sap"}, err: true},
+	} {
+		got, err := honoredLabels(tc.labels)
+		if (err != nil) != tc.err {
+			t.Errorf("%v: unexpected error %v", tc.labels, err)
+			continue
+		}
+		if !tc.err && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: expected %v, got %v", tc.labels, tc.want, got)
+		}
+	}
+}
+
+func TestApplyLabels(t *testing.T) {
+	labels := map[string]string{
+		labelPrefix + labelRoot:         "dist",
+		labelPrefix + labelSPA:          "true",
+		labelPrefix + labelCacheControl: "max-age=60",
+		labelPrefix + labelCORS:         "https://a.test, https://b.test",
+	}
+
+	a := New()
+	s := a.applyLabels(site{}, labels)
+	want := site{root: "/dist", spa: true, cacheControl: "max-age=60", cors: []string{"https://a.test", "https://b.test"}}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("expected %+v, got %+v", want, s)
+	}
+
+	// The root set by the operator takes precedence
+	if s := a.applyLabels(site{root: "/public"}, labels); s.root != "/public" {
+		t.Errorf("expected the root not to be overridden, got %s", s.root)
+	}
+	// An empty standalone root honors the label
+	standalone := New(WithRoot(""))
+	if s := standalone.applyLabels(site{root: standalone.standaloneRoot}, labels); s.root != "/dist" {
+		t.Errorf("expected the label root, got %s", s.root)
+	}
+
+	if s := New(WithLabels("cors")).applyLabels(site{}, labels); s.root != "" || s.spa || len(s.cors) != 2 {
+		t.Errorf("expected only cors to be honored, got %+v", s)
+	}
+	if s := New(WithLabels("none")).applyLabels(site{}, labels); !reflect.DeepEqual(s, site{}) {
+		t.Errorf("expected no label to be honored, got %+v", s)
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import "container/list"
+
+// defaultCacheEntries is the number of entries kept by in memory caches
+// keyed by client input, like image references and host names
+const defaultCacheEntries = 10000
+
+// lruCache holds up to size entries, evicting the least recently used
+// ones, defaultCacheEntries if size is 0. It isn't safe for concurrent
+// use, callers hold their own lock
+type lruCache struct {
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+func (c *lruCache) set(key string, value interface{}) {
+	if c.entries == nil {
+		c.ll = list.New()
+		c.entries = make(map[string]*list.Element)
+	}
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry).value = value
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(&lruEntry{key: key, value: value})
+
+	size := c.size
+	if size <= 0 {
+		size = defaultCacheEntries
+	}
+	for c.ll.Len() > size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.entries, e.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) len() int {
+	return len(c.entries)
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+)
+
+const (
+	// magicBase32Prefix starts the labels encoding a reference in base32
+	magicBase32Prefix = "b32-"
+	// magicDigestPrefix starts the labels of a sha256 digest, split in two
+	// as the hex digest is longer than a DNS label
+	magicDigestPrefix = "sha256-"
+
+	maxLabelLength = 63
+	maxHostLength  = 253
+)
+
+var magicBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// parseMagicHost returns the image encoded in host, a subdomain of the
+// magic DNS domain. The labels before the domain are one of:
+//
+//	registry.org.container.tag
+//	<repository>.sha256-<first 32 hex>.<last 32 hex>
+//	b32-<base32 reference>
+//
+// where the repository is either registry.org.container or b32-<base32 repository>.
+// The base32 labels can be split at any point, as labels are at most 63 characters
+func parseMagicHost(host, domain string) (string, bool) {
+	host = normalizeHost(host)
+	domain = "." + strings.Trim(strings.ToLower(domain), ".")
+	if !strings.HasSuffix(host, domain) {
+		return "", false
+	}
+	fields := strings.Split(strings.TrimSuffix(host, domain), ".")
+
+	image := ""
+	n := len(fields)
+	switch {
+	case n >= 3 && strings.HasPrefix(fields[n-2], magicDigestPrefix):
+		digest := strings.TrimPrefix(fields[n-2], magicDigestPrefix) + fields[n-1]
+		if _, err := hex.DecodeString(digest); err != nil || len(digest) != 64 {
+			return "", false
+		}
+		repo, ok := magicRepository(fields[:n-2])
+		if !ok {
+			return "", false
+		}
+		image = repo + "@sha256:" + digest
+	case strings.HasPrefix(fields[0], magicBase32Prefix):
+		ref, ok := decodeMagicBase32(fields)
+		if !ok {
+			return "", false
+		}
+		image = ref
+	case n >= 4:
+		// pop the tag, the rest is the repository
+		repo, ok := magicRepository(fields[:n-1])
+		if !ok {
+			return "", false
+		}
+		image = repo + ":" + fields[n-1]
+	default:
+		return "", false
+	}
+
+	if _, err := name.ParseReference(image); err != nil {
+		return "", false
+	}
+	return image, true
+}
+
+// magicRepository returns the repository encoded in fields,
+// either in base32 or as registry.org.container
+func magicRepository(fields []string) (string, bool) {
+	if strings.HasPrefix(fields[0], magicBase32Prefix) {
+		return decodeMagicBase32(fields)
+	}
+	n := len(fields)
+	if n < 3 {
+		return "", false
+	}
+	return strings.Join(fields[:n-2], ".") + "/" + fields[n-2] + "/" + fields[n-1], true
+}
+
+func decodeMagicBase32(fields []string) (string, bool) {
+	enc := strings.TrimPrefix(strings.Join(fields, ""), magicBase32Prefix)
+	dat, err := magicBase32.DecodeString(strings.ToUpper(enc))
+	if err != nil {
+		return "", false
+	}
+	return string(dat), true
+}
+
+// encodeMagicBase32 encodes s in base32 labels
+func encodeMagicBase32(s string) string {
+	enc := magicBase32Prefix + strings.ToLower(magicBase32.EncodeToString([]byte(s)))
+	labels := []string{}
+	for len(enc) > maxLabelLength {
+		labels = append(labels, enc[:maxLabelLength])
+		enc = enc[maxLabelLength:]
+	}
+	return strings.Join(append(labels, enc), ".")
+}
+
+// MagicDNSHost returns the host name serving image under the magic DNS
+// domain. The readable registry.org.container.tag form is preferred,
+// the base32 one is used for what it can't express
+func MagicDNSHost(image, domain string) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid image '%s'", image)
+	}
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	if domain == "" {
+		return "", errors.New("magic DNS domain is required")
+	}
+
+	repo := ref.Context()
+	readable := repo.RegistryStr() + "." + strings.ReplaceAll(repo.RepositoryStr(), "/", ".")
+
+	candidates := []string{}
+	switch r := ref.(type) {
+	case name.Tag:
+		candidates = append(candidates, readable+"."+r.TagStr())
+	case name.Digest:
+		if digest := strings.TrimPrefix(r.DigestStr(), "sha256:"); len(digest) == 64 {
+			labels := "." + magicDigestPrefix + digest[:32] + "." + digest[32:]
+			candidates = append(candidates, readable+labels, encodeMagicBase32(repo.Name())+labels)
+		}
+	}
+	candidates = append(candidates, encodeMagicBase32(ref.Name()))
+
+	for _, c := range candidates {
+		host := c + "." + domain
+		if !validHost(host) {
+			continue
+		}
+		// Only forms which round-trip are valid
+		decoded, ok := parseMagicHost(host, domain)
+		if !ok {
+			continue
+		}
+		if d, err := name.ParseReference(decoded); err == nil && d.Name() == ref.Name() {
+			return host, nil
+		}
+	}
+	return "", errors.Errorf("image '%s' is too long to be encoded in a host name", image)
+}
+
+// validHost returns true if host is a valid DNS name
+func validHost(host string) bool {
+	if len(host) > maxHostLength {
+		return false
+	}
+	for _, l := range strings.Split(host, ".") {
+		if l == "" || len(l) > maxLabelLength || strings.HasPrefix(l, "-") || strings.HasSuffix(l, "-") {
+			return false
+		}
+		for _, c := range l {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestParseMagicHost(t *testing.T) {
+	digest := strings.Repeat("0123456789abcdef", 4)
+	for _, tc := range []struct {
+		host  string
+		image string
+	}{
+		{host: "docker.io.library.nginx.latest.containerbay.io", image: "docker.io/library/nginx:latest"},
+		{host: "ghcr.io.org.site.v1.containerbay.io:8080", image: "ghcr.io/org/site:v1"},
+		{host: "GHCR.IO.Org.Site.V1.ContainerBay.IO.", image: "ghcr.io/org/site:v1"},
+		{host: "ghcr.io.org.site.sha256-" + digest[:32] + "." + digest[32:] + ".containerbay.io", image: "ghcr.io/org/site@sha256:" + digest},
+		{host: encodeMagicBase32("registry.local:5000/org/team/site:V1_x") + ".containerbay.io", image: "registry.local:5000/org/team/site:V1_x"},
+		{host: encodeMagicBase32("ghcr.io/org/team/site") + ".sha256-" + digest[:32] + "." + digest[32:] + ".containerbay.io", image: "ghcr.io/org/team/site@sha256:" + digest},
+
+		// Not magic hosts
+		{host: "containerbay.io"},
+		{host: "example.com"},
+		{host: "ghcr.io.org.site.v1.containerbay.io.example.com"},
+		{host: "org.site.v1.containerbay.io"},
+		{host: "ghcr.io.org.site.sha256-abc.def.containerbay.io"},
+		{host: "ghcr.io.org.site.sha256-" + strings.Repeat("z", 32) + "." + digest[32:] + ".containerbay.io"},
+		{host: "b32-!!!.containerbay.io"},
+		{host: encodeMagicBase32("not a reference") + ".containerbay.io"},
+	} {
+		image, ok := parseMagicHost(tc.host, "containerbay.io")
+		if ok != (tc.image != "") || image != tc.image {
+			t.Errorf("%s: expected '%s', got '%s' %t", tc.host, tc.image, image, ok)
+		}
+	}
+}
+
+func TestMagicDNSHostRoundTrip(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("0123456789abcdef", 4)
+	for _, tc := range []struct {
+		image string
+		host  string
+	}{
+		// The readable forms are preferred
+		{image: "ghcr.io/org/site:v1", host: "ghcr.io.org.site.v1.containerbay.io"},
+		{image: "ghcr.io/org/site@" + digest, host: "ghcr.io.org.site.sha256-" + digest[7:39] + "." + digest[39:] + ".containerbay.io"},
+		// docker.io/library is implicit in the image, not in the host
+		{image: "nginx", host: "index.docker.io.library.nginx.latest.containerbay.io"},
+
+		{image: "ghcr.io/org/site:V1.2_rc"},
+		{image: "registry.local:5000/site:v1"},
+		{image: "localhost/org/site:v1"},
+		{image: "ghcr.io/org/team/site:v1"},
+		{image: "ghcr.io/org/my_site:v1"},
+		{image: "registry.local:5000/org/team/site@" + digest},
+		{image: "ghcr.io/" + strings.Repeat("a", 70) + "/site:v1"},
+	} {
+		host, err := MagicDNSHost(tc.image, "containerbay.io.")
+		if err != nil {
+			t.Errorf("%s: %v", tc.image, err)
+			continue
+		}
+		if tc.host != "" && host != tc.host {
+			t.Errorf("%s: expected %s, got %s", tc.image, tc.host, host)
+		}
+		if !validHost(host) {
+			t.Errorf("%s: invalid host %s", tc.image, host)
+		}
+
+		image, ok := parseMagicHost(host, "containerbay.io")
+		if !ok {
+			t.Errorf("%s: %s doesn't round-trip", tc.image, host)
+			continue
+		}
+		want, _ := name.ParseReference(tc.image)
+		got, _ := name.ParseReference(image)
+		if got == nil || got.Name() != want.Name() {
+			t.Errorf("%s: %s decodes to %s", tc.image, host, image)
+		}
+	}
+}
+
+func TestMagicDNSHostErrors(t *testing.T) {
+	for _, tc := range []struct{ image, domain string }{
+		{image: "Invalid Image", domain: "containerbay.io"},
+		{image: "ghcr.io/org/site:v1", domain: ""},
+		{image: "ghcr.io/org/" + strings.Repeat("a", 200) + ":v1", domain: "containerbay.io"},
+	} {
+		if host, err := MagicDNSHost(tc.image, tc.domain); err == nil {
+			t.Errorf("%s %s: expected an error, got %s", tc.image, tc.domain, host)
+		}
+	}
+}
+
+func TestValidHost(t *testing.T) {
+	for host, valid := range map[string]bool{
+		"ghcr.io.org.site.v1.containerbay.io": true,
+		"b32-abc.containerbay.io":             true,
+		"a..b":                                false,
+		"-a.b":                                false,
+		"a-.b":                                false,
+		"A.b":                                 false,
+		"a_b.c":                               false,
+		strings.Repeat("a", 64) + ".b":        false,
+		strings.Repeat("a.", 127) + "bb":      false,
+	} {
+		if validHost(host) != valid {
+			t.Errorf("%s: expected valid=%t", host, valid)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package api
 
 import (
+	"path"
+	"time"
+
 	units "github.com/docker/go-units"
 	"github.com/moby/moby/api/types"
-	"github.com/mudler/containerbay/store"
 	str2duration "github.com/xhit/go-str2duration/v2"
 )
 
@@ -20,10 +22,44 @@ func WithDNSField(s string) func(*API) error {
 }
 
 // WithWhitelist adds a list of regexes to be whiteliste of the images that can be served.
-// Those that doesn't match regexes are refused
+// Those that doesn't match regexes are refused.
+// The regexes are added as allow rules after the ones of the policy file
 func WithWhitelist(s ...string) func(*API) error {
 	return func(a *API) error {
-		a.whitelist = append(a.whitelist, s...)
+		a.policy.whitelist = append(a.policy.whitelist, s...)
+		return nil
+	}
+}
+
+// WithPolicy sets the rules deciding which images can be served.
+// A policy file, if set, takes precedence
+func WithPolicy(p *Policy) func(*API) error {
+	return func(a *API) error {
+		a.policy.inline = p
+		_, err := compilePolicy(p, nil)
+		return err
+	}
+}
+
+// WithPolicyFile sets a YAML or JSON file with the rules deciding which images
+// can be served, e.g.:
+//
+//	rules:
+//	- action: allow
+//	  match:
+//	    registry: ghcr.io
+//	    repository: ourorg/**
+//	  maxSize: 500MB
+//	- action: deny
+//	  match:
+//	    labels:
+//	      org.example.blocked: "*"
+//	default: deny
+//
+// The file is reloaded when it changes
+func WithPolicyFile(s string) func(*API) error {
+	return func(a *API) error {
+		a.policy.file = s
 		return nil
 	}
 }
@@ -46,6 +82,41 @@ func WithListeningAddress(s string) func(*API) error {
 	}
 }
 
+// WithDNSResolver sets the address (ip:port) of the DNS server used to look up
+// TXT records. By default the first nameserver of /etc/resolv.conf is used
+func WithDNSResolver(s string) func(*API) error {
+	return func(a *API) error {
+		a.dns.server = s
+		return nil
+	}
+}
+
+// WithDNSMinTTL sets the minimum time TXT records lookups are cached for,
+// regardless of their TTL
+func WithDNSMinTTL(s string) func(*API) error {
+	return func(a *API) error {
+		durationFromString, err := str2duration.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		a.dns.minTTL = durationFromString
+		return nil
+	}
+}
+
+// WithDNSMaxTTL sets the maximum time TXT records lookups are cached for,
+// regardless of their TTL
+func WithDNSMaxTTL(s string) func(*API) error {
+	return func(a *API) error {
+		durationFromString, err := str2duration.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		a.dns.maxTTL = durationFromString
+		return nil
+	}
+}
+
 // WithMagicDNS sets the magic dns domain used to query the images from
 // e.g. to allow requests like http://registry.org.image.tag.magicdns
 func WithMagicDNS(s string) func(*API) error {
@@ -58,8 +129,35 @@ func WithMagicDNS(s string) func(*API) error {
 // WithCacheStore sets the cache store where all container images will be stored
 func WithCacheStore(s string) func(*API) error {
 	return func(a *API) error {
-		a.cacheStore = store.New(s)
-		return a.cacheStore.EnsureExists()
+		a.storeDir = s
+		return nil
+	}
+}
+
+// WithStoreMaxSize sets the max total size of the cache store.
+// When exceeded, the least recently used images are evicted first.
+// Valid values are e.g. 500MB, 20GB, etc.
+func WithStoreMaxSize(s string) func(*API) error {
+	return func(a *API) error {
+		size, err := units.FromHumanSize(s)
+		if err != nil {
+			return err
+		}
+		a.storeMaxSize = size
+		return nil
+	}
+}
+
+// WithStoreMaxAge sets the max time an image can stay in the cache store
+// without being accessed. The age is a string and specifies a duration, e.g. 10m, 2h, 7d
+func WithStoreMaxAge(s string) func(*API) error {
+	return func(a *API) error {
+		durationFromString, err := str2duration.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		a.storeMaxAge = durationFromString
+		return nil
 	}
 }
 
@@ -77,6 +175,159 @@ func WithCleanupInterval(s string) func(*API) error {
 	}
 }
 
+// WithResolveCacheTTL sets for how long an image reference resolved to a digest
+// is trusted before asking again to the registry.
+// The TTL is a string and specifies a duration, e.g. 30s, 5m, 1h
+func WithResolveCacheTTL(s string) func(*API) error {
+	return func(a *API) error {
+		durationFromString, err := str2duration.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		a.resolver.ttl = durationFromString
+		return nil
+	}
+}
+
+// WithNegativeCacheTTL sets for how long a failure resolving an image
+// reference is cached before trying again against the registry
+func WithNegativeCacheTTL(s string) func(*API) error {
+	return func(a *API) error {
+		durationFromString, err := str2duration.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		a.resolver.negativeTTL = durationFromString
+		return nil
+	}
+}
+
+// WithStaleWhileRevalidate keeps serving expired resolutions while they are
+// refreshed in background, and keeps serving them if the registry
+// is unreachable
+func WithStaleWhileRevalidate(b bool) func(*API) error {
+	return func(a *API) error {
+		a.resolver.stale = b
+		return nil
+	}
+}
+
+// WithWait sets how long requests wait for an image which is not in the cache
+// to be ready before replying that it is still processing.
+// By default requests don't wait. It can be set per request with the
+// "wait" query parameter or the "Prefer: wait=<seconds>" header
+func WithWait(s string) func(*API) error {
+	return func(a *API) error {
+		durationFromString, err := str2duration.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		a.wait = durationFromString
+		return nil
+	}
+}
+
+// WithMaxWait sets the max time a request can wait for an image to be ready
+func WithMaxWait(s string) func(*API) error {
+	return func(a *API) error {
+		durationFromString, err := str2duration.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		a.maxWait = durationFromString
+		return nil
+	}
+}
+
+// WithRetryAfter sets after how long clients are told to retry
+// while an image is being processed
+func WithRetryAfter(s string) func(*API) error {
+	return func(a *API) error {
+		durationFromString, err := str2duration.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		a.retryAfter = durationFromString
+		return nil
+	}
+}
+
+// WithProcessingPage sets the path of an HTML template which is rendered
+// while an image is being processed. The template can refer to
+// {{.Image}} and {{.RetryAfter}} (in seconds)
+func WithProcessingPage(s string) func(*API) error {
+	return func(a *API) error {
+		a.processingPage = s
+		return nil
+	}
+}
+
+// WithRoutes sets static routes serving images for hosts and path
+// prefixes, which are looked up before magic DNS and TXT records
+func WithRoutes(routes ...Route) func(*API) error {
+	return func(a *API) error {
+		a.routes.inline = append(a.routes.inline, routes...)
+		_, err := compileRoutes(routes)
+		return err
+	}
+}
+
+// WithRoutesFile sets a configuration file to read the static routes from,
+// instead of the ones set with WithRoutes. The routes are reloaded when it changes
+func WithRoutesFile(s string) func(*API) error {
+	return func(a *API) error {
+		a.routes.file = s
+		return nil
+	}
+}
+
+// WithDenylistFile sets the file where the blocked references and digests
+// are persisted. By default it is kept in the cache store
+func WithDenylistFile(s string) func(*API) error {
+	return func(a *API) error {
+		a.denylist.file = s
+		return nil
+	}
+}
+
+// WithAdminToken sets the bearer token required by the admin endpoints,
+// which are disabled if it is empty
+func WithAdminToken(s string) func(*API) error {
+	return func(a *API) error {
+		a.adminToken = s
+		return nil
+	}
+}
+
+// WithDomainVerification requires the domains bound to images by TXT
+// records to be verified, either by the token of the record or by the
+// domains label of the image
+func WithDomainVerification(b bool) func(*API) error {
+	return func(a *API) error {
+		a.domainVerification = b
+		return nil
+	}
+}
+
+// WithDomainSecret sets the secret the domain verification tokens
+// are derived from, see DomainToken
+func WithDomainSecret(s string) func(*API) error {
+	return func(a *API) error {
+		a.domainSecret = s
+		return nil
+	}
+}
+
+// WithSignatureVerification requires the images matching the regex pattern to be
+// signed with cosign by at least one of the public keys (PEM files) given.
+// Images which are not signed, or with an invalid signature, are refused
+func WithSignatureVerification(pattern string, keys ...string) func(*API) error {
+	return func(a *API) error {
+		a.signatures.policies = append(a.signatures.policies, &signaturePolicy{rawPattern: pattern, keyPaths: keys})
+		return nil
+	}
+}
+
 // WithMaxSize specifies a max size of the images to be served. Images bigger
 // than the specified size are not served and an error to the client is returned
 // Valid values are e.g. 10MB, 2GB, etc.
@@ -91,6 +342,37 @@ func WithMaxSize(s string) func(*API) error {
 	}
 }
 
+// WithSPA serves the images as single page applications, where the
+// missing paths without an extension serve the index.html of the root
+func WithSPA(b bool) func(*API) error {
+	return func(a *API) error {
+		a.spa = b
+		return nil
+	}
+}
+
+// WithErrorImage sets the image the error pages are served from, e.g. 404.html
+// or 50x.html at its root, when the served image doesn't have them
+func WithErrorImage(s string) func(*API) error {
+	return func(a *API) error {
+		a.errorImage = s
+		return nil
+	}
+}
+
+// WithLabels restricts the image labels configuring how images are served
+// to the given ones, e.g. root or spa, none to ignore all of them
+func WithLabels(labels ...string) func(*API) error {
+	return func(a *API) error {
+		honored, err := honoredLabels(labels)
+		if err != nil {
+			return err
+		}
+		a.labels = honored
+		return nil
+	}
+}
+
 // WithPoolSize specify a size for the queue of the worker pool
 func WithPoolSize(i int) func(*API) error {
 	return func(a *API) error {
@@ -111,22 +393,77 @@ func WithWorkers(i int) func(*API) error {
 // WithAuth specify an authentication which is used to perform
 // image pulls.
 // This is mostly required to access to private registries or either
-// workaround Pull rate limits
+// workaround Pull rate limits.
+// If the ServerAddress is set, it is used only for that registry
 func WithAuth(auth *types.AuthConfig) func(*API) error {
 	return func(a *API) error {
-		// auth := &types.AuthConfig{
-		// 	Username:      user,
-		// 	Password:      pass,
-		// 	ServerAddress: server,
-		// 	Auth:          authType,
-		// 	IdentityToken: identity,
-		// 	RegistryToken: registryToken,
-		// }
 		a.auth = auth
 		return nil
 	}
 }
 
+// WithPlatform sets the default platform (os/arch[/variant], e.g. linux/arm64)
+// of the images to serve when a reference points to a multi-arch index.
+// It can be set per request with the "platform" query parameter
+func WithPlatform(s string) func(*API) error {
+	return func(a *API) error {
+		p, err := parsePlatform(s)
+		if err != nil {
+			return err
+		}
+		a.platform = p
+		return nil
+	}
+}
+
+// WithCredentials adds credentials for specific registries or repositories
+func WithCredentials(c Credentials) func(*API) error {
+	return func(a *API) error {
+		if a.credentials == nil {
+			a.credentials = Credentials{}
+		}
+		for k, v := range c {
+			a.credentials[k] = v
+		}
+		return c.Validate()
+	}
+}
+
+// WithCredentialsFile sets a YAML or JSON file to read credentials for
+// specific registries or repositories from, e.g.:
+//
+//	ghcr.io/org:
+//	  username: bot
+//	  password:
+//	    file: /secrets/ghcr/password
+//	registry.example.com:
+//	  token:
+//	    env: REGISTRY_TOKEN
+func WithCredentialsFile(s string) func(*API) error {
+	return func(a *API) error {
+		a.credentialsFile = s
+		return nil
+	}
+}
+
+// WithDockerConfig sets the path of a docker config.json file to read
+// registry credentials from. Credential helpers referenced in it are used as well
+func WithDockerConfig(s string) func(*API) error {
+	return func(a *API) error {
+		a.dockerConfig = s
+		return nil
+	}
+}
+
+// WithDefaultKeychain enables reading registry credentials from the default
+// docker configuration ($DOCKER_CONFIG or ~/.docker/config.json) and its credential helpers
+func WithDefaultKeychain(b bool) func(*API) error {
+	return func(a *API) error {
+		a.defaultKeychain = b
+		return nil
+	}
+}
+
 // Standalone sets the standalone image to serve requests from.
 func Standalone(image string) func(*API) error {
 	return func(a *API) error {
@@ -135,11 +472,30 @@ func Standalone(image string) func(*API) error {
 	}
 }
 
+// WithRoot sets the directory of the standalone image served as web root.
+// If empty, the root label of the image is honored, / otherwise
+func WithRoot(root string) func(*API) error {
+	return func(a *API) error {
+		a.standaloneRoot = ""
+		if root != "" {
+			a.standaloneRoot = path.Clean("/" + root)
+		}
+		return nil
+	}
+}
+
 // New returns a new API instance with the given options
 func New(opts ...Options) *API {
 	a := &API{
-		workers:   1,
-		dnsTXTKey: "containerbay",
+		workers:    1,
+		dnsTXTKey:  "containerbay",
+		maxWait:    time.Minute,
+		retryAfter: 5 * time.Second,
+		dns: txtResolver{
+			minTTL:  defaultDNSMinTTL,
+			maxTTL:  defaultDNSMaxTTL,
+			timeout: defaultDNSTimeout,
+		},
 	}
 	for _, o := range opts {
 		o(a)
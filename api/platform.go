@@ -0,0 +1,120 @@
+package api
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// platformPathPrefix marks a path segment selecting the platform,
+// e.g. /docker.io/library/alpine/+linux-arm64-v8/etc/os-release
+const platformPathPrefix = "+"
+
+const platformsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Image}}</title>
+</head>
+<body>
+<p><code>{{.Image}}</code> is available for the following platforms:</p>
+<ul>
+{{- range .Platforms}}
+<li><a href="?platform={{.}}">{{.}}</a></li>
+{{- end}}
+</ul>
+</body>
+</html>
+`
+
+var platformsTmpl = template.Must(template.New("platforms").Parse(platformsPage))
+
+// parsePlatform parses a platform in the os/arch[/variant] form
+func parsePlatform(s string) (*v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.Errorf("invalid platform '%s', expected os/arch[/variant]", s)
+	}
+	p := &v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// parsePlatformSegment parses a platform from a path segment
+// in the +os-arch[-variant] form
+func parsePlatformSegment(s string) (*v1.Platform, error) {
+	return parsePlatform(strings.ReplaceAll(strings.TrimPrefix(s, platformPathPrefix), "-", "/"))
+}
+
+// platformString returns p in the os/arch[/variant] form
+func platformString(p v1.Platform) string {
+	s := fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// platformMatches returns true if have satisfies want. The variant
+// is compared only if requested
+func platformMatches(want, have v1.Platform) bool {
+	return want.OS == have.OS && want.Architecture == have.Architecture &&
+		(want.Variant == "" || want.Variant == have.Variant)
+}
+
+// storeKey returns the key an image is stored with, which
+// includes the platform it was built for if known
+func storeKey(h v1.Hash, p v1.Platform) string {
+	if p.OS == "" && p.Architecture == "" {
+		return h.Hex
+	}
+	return strings.Join(append(strings.Split(platformString(p), "/"), h.Hex), "-")
+}
+
+// requestPlatform returns the platform requested with the "platform" query
+// parameter, the one given or the instance default, in this order
+func (a *API) requestPlatform(c echo.Context, platform *v1.Platform) (*v1.Platform, error) {
+	if q := c.QueryParam("platform"); q != "" {
+		return parsePlatform(q)
+	}
+	if platform != nil {
+		return platform, nil
+	}
+	return a.platform, nil
+}
+
+type platformsListing struct {
+	Image     string   `json:"image"`
+	Platforms []string `json:"platforms"`
+}
+
+// renderPlatforms lists the platforms res is available for
+func renderPlatforms(c echo.Context, code int, image string, res *resolution) error {
+	l := platformsListing{Image: image, Platforms: []string{}}
+	for _, p := range res.platforms {
+		l.Platforms = append(l.Platforms, platformString(p))
+	}
+	if len(res.platforms) == 0 && !res.noMatch {
+		l.Platforms = append(l.Platforms, platformString(res.platform))
+	}
+
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+		return c.JSON(code, l)
+	}
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().WriteHeader(code)
+	return platformsTmpl.Execute(c.Response(), l)
+}
+
+// isPlatformsRequest returns true if the request asks for the
+// platforms listing
+func isPlatformsRequest(c echo.Context) bool {
+	_, ok := c.QueryParams()["platforms"]
+	return ok
+}
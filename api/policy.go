@@ -0,0 +1,365 @@
+package api
+
+import (
+	"crypto"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+
+	units "github.com/docker/go-units"
+	"github.com/gobwas/glob"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// Policy is an ordered list of rules deciding which images can be served.
+// The first rule matching an image decides, if none matches the default
+// action is taken
+type Policy struct {
+	Rules []PolicyRule `json:"rules,omitempty"`
+	// Default is the action taken when no rule matches, allow if empty
+	Default string `json:"default,omitempty"`
+}
+
+// PolicyRule allows or denies the images it matches, and can override
+// how the allowed ones are served
+type PolicyRule struct {
+	// Action is either allow or deny
+	Action string      `json:"action"`
+	Match  PolicyMatch `json:"match,omitempty"`
+
+	// MaxSize overrides the max size of the images, e.g. 500MB
+	MaxSize string `json:"maxSize,omitempty"`
+	// Signatures are public keys (PEM files) the images must be
+	// signed with by cosign, any of them is accepted
+	Signatures []string `json:"signatures,omitempty"`
+	// Auth is the credential used to pull the images
+	Auth *Credential `json:"auth,omitempty"`
+}
+
+// PolicyMatch selects images. All the fields given have to match.
+// Registry, repository, tag, digest and label values are glob patterns
+// where * doesn't cross a / and ** does, e.g. ourorg/**
+type PolicyMatch struct {
+	// Image is a regex matched against the image reference as requested
+	Image      string `json:"image,omitempty"`
+	Registry   string `json:"registry,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	// Platform is in the os/arch[/variant] form
+	Platform string            `json:"platform,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// LoadPolicy reads a policy from a YAML or JSON file
+func LoadPolicy(path string) (*Policy, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := yaml.UnmarshalStrict(dat, p); err != nil {
+		return nil, errors.Wrapf(err, "while parsing policy '%s'", path)
+	}
+	if _, err := compilePolicy(p, nil); err != nil {
+		return nil, errors.Wrapf(err, "invalid policy '%s'", path)
+	}
+	return p, nil
+}
+
+type policyRule struct {
+	allow bool
+
+	image                             *regexp.Regexp
+	registry, repository, tag, digest glob.Glob
+	platform                          *v1.Platform
+	labels                            map[string]glob.Glob
+
+	maxSize  int64
+	keyPaths []string
+	keys     []crypto.PublicKey
+	auth     *Credential
+}
+
+// policy is the compiled form of a Policy
+type policy struct {
+	rules []*policyRule
+	allow bool
+}
+
+func compileGlob(field, pattern string) (glob.Glob, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	g, err := glob.Compile(pattern, '/')
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s pattern '%s'", field, pattern)
+	}
+	return g, nil
+}
+
+func compileAction(action string) (bool, error) {
+	switch action {
+	case policyAllow:
+		return true, nil
+	case policyDeny:
+		return false, nil
+	}
+	return false, errors.Errorf("invalid action '%s', expected %s or %s", action, policyAllow, policyDeny)
+}
+
+func compileRule(r PolicyRule) (*policyRule, error) {
+	allow, err := compileAction(r.Action)
+	if err != nil {
+		return nil, err
+	}
+	rule := &policyRule{allow: allow, auth: r.Auth, keyPaths: r.Signatures}
+
+	m := r.Match
+	if m.Image != "" {
+		if rule.image, err = regexp.Compile(m.Image); err != nil {
+			return nil, errors.Wrapf(err, "invalid image regex '%s'", m.Image)
+		}
+	}
+
+	// References to the Docker Hub are normalized to its registry name
+	if m.Registry == "docker.io" {
+		m.Registry = name.DefaultRegistry
+	}
+	if rule.registry, err = compileGlob("registry", m.Registry); err != nil {
+		return nil, err
+	}
+	if rule.repository, err = compileGlob("repository", m.Repository); err != nil {
+		return nil, err
+	}
+	if rule.tag, err = compileGlob("tag", m.Tag); err != nil {
+		return nil, err
+	}
+	if rule.digest, err = compileGlob("digest", m.Digest); err != nil {
+		return nil, err
+	}
+	if m.Platform != "" {
+		if rule.platform, err = parsePlatform(m.Platform); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range m.Labels {
+		g, err := compileGlob("label "+k, v)
+		if err != nil {
+			return nil, err
+		}
+		if rule.labels == nil {
+			rule.labels = map[string]glob.Glob{}
+		}
+		rule.labels[k] = g
+	}
+
+	if r.MaxSize != "" {
+		if rule.maxSize, err = units.FromHumanSize(r.MaxSize); err != nil {
+			return nil, errors.Wrapf(err, "invalid maxSize '%s'", r.MaxSize)
+		}
+	}
+	if r.Auth != nil && rule.registry == nil {
+		return nil, errors.New("rules with auth must match a registry")
+	}
+	return rule, nil
+}
+
+// compilePolicy compiles p. Each regex of whitelist is added as an allow rule
+// after the ones of p, and if there are any the default action is deny
+func compilePolicy(p *Policy, whitelist []string) (*policy, error) {
+	res := &policy{allow: true}
+	if p != nil {
+		if p.Default != "" {
+			allow, err := compileAction(p.Default)
+			if err != nil {
+				return nil, errors.Wrap(err, "default")
+			}
+			res.allow = allow
+		}
+
+		for i, r := range p.Rules {
+			rule, err := compileRule(r)
+			if err != nil {
+				return nil, errors.Wrapf(err, "rule %d", i+1)
+			}
+			res.rules = append(res.rules, rule)
+		}
+	}
+
+	for _, w := range whitelist {
+		rule, err := compileRule(PolicyRule{Action: policyAllow, Match: PolicyMatch{Image: w}})
+		if err != nil {
+			return nil, errors.Wrap(err, "whitelist")
+		}
+		res.rules = append(res.rules, rule)
+		res.allow = false
+	}
+	return res, nil
+}
+
+// loadKeys reads the public keys required by the rules
+func (p *policy) loadKeys() error {
+	for i, r := range p.rules {
+		r.keys = nil
+		for _, path := range r.keyPaths {
+			key, err := loadPublicKey(path)
+			if err != nil {
+				return errors.Wrapf(err, "rule %d", i+1)
+			}
+			r.keys = append(r.keys, key)
+		}
+	}
+	return nil
+}
+
+// needsResolution returns true if the rule matches on details
+// known only once the reference is resolved
+func (r *policyRule) needsResolution(ref name.Reference) bool {
+	_, isDigest := ref.(name.Digest)
+	return r.platform != nil || len(r.labels) > 0 || (r.digest != nil && !isDigest)
+}
+
+func (r *policyRule) matches(image string, ref name.Reference, res *resolution) bool {
+	if r.image != nil && !r.image.MatchString(image) {
+		return false
+	}
+	if r.registry != nil && !r.registry.Match(ref.Context().RegistryStr()) {
+		return false
+	}
+	if r.repository != nil && !r.repository.Match(ref.Context().RepositoryStr()) {
+		return false
+	}
+	if r.tag != nil {
+		t, ok := ref.(name.Tag)
+		if !ok || !r.tag.Match(t.TagStr()) {
+			return false
+		}
+	}
+	if r.digest != nil {
+		digest := ""
+		if d, ok := ref.(name.Digest); ok {
+			digest = d.DigestStr()
+		} else if res != nil {
+			digest = res.digest.String()
+		}
+		if !r.digest.Match(digest) {
+			return false
+		}
+	}
+	if r.platform != nil && (res == nil || !platformMatches(*r.platform, res.platform)) {
+		return false
+	}
+	for k, g := range r.labels {
+		if res == nil {
+			return false
+		}
+		v, ok := res.labels[k]
+		if !ok || !g.Match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// decide returns whether image can be served and the rule deciding it, nil if
+// none matched. Without a resolution, ok is false if the decision depends on it
+func (p *policy) decide(image string, ref name.Reference, res *resolution) (allow bool, rule *policyRule, ok bool) {
+	for _, r := range p.rules {
+		if res == nil && r.needsResolution(ref) {
+			return false, nil, false
+		}
+		if r.matches(image, ref, res) {
+			return r.allow, r, true
+		}
+	}
+	return p.allow, nil, true
+}
+
+// Resolve implements authn.Keychain with the auth of the first rule
+// matching the registry and repository of target
+func (p *policy) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	repo := strings.TrimPrefix(strings.TrimPrefix(target.String(), target.RegistryStr()), "/")
+	for _, r := range p.rules {
+		if r.auth == nil || !r.registry.Match(target.RegistryStr()) {
+			continue
+		}
+		if r.repository != nil && (repo == "" || !r.repository.Match(repo)) {
+			continue
+		}
+		auth, err := r.auth.authConfig()
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading policy credentials for '%s'", target)
+		}
+		return staticAuth{auth}, nil
+	}
+	return authn.Anonymous, nil
+}
+
+// policyStore holds the policy in use, reloading it from
+// its file when it changes
+type policyStore struct {
+	sync.RWMutex
+	file      string
+	inline    *Policy
+	whitelist []string
+
+	current *policy
+
+	// onReload is called after the policy is replaced
+	onReload func()
+}
+
+func (s *policyStore) get() *policy {
+	s.RLock()
+	defer s.RUnlock()
+	return s.current
+}
+
+// load compiles the policy from its file, or the inline one
+// if there is no file, and the whitelist
+func (s *policyStore) load() error {
+	p := s.inline
+	if s.file != "" {
+		var err error
+		if p, err = LoadPolicy(s.file); err != nil {
+			return err
+		}
+	}
+
+	compiled, err := compilePolicy(p, s.whitelist)
+	if err != nil {
+		return err
+	}
+	if err := compiled.loadKeys(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.current = compiled
+	s.Unlock()
+
+	if s.onReload != nil {
+		s.onReload()
+	}
+	return nil
+}
+
+// Resolve implements authn.Keychain with the policy in use
+func (s *policyStore) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	p := s.get()
+	if p == nil {
+		return authn.Anonymous, nil
+	}
+	return p.Resolve(target)
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestPolicyDecide(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	p, err := compilePolicy(&Policy{
+		Rules: []PolicyRule{
+			{Action: policyDeny, Match: PolicyMatch{Repository: "ourorg/private/**"}},
+			{Action: policyAllow, Match: PolicyMatch{Registry: "ghcr.io", Repository: "ourorg/**"}, MaxSize: "1MB"},
+			{Action: policyDeny, Match: PolicyMatch{Labels: map[string]string{"org.example.blocked": "*"}}},
+			{Action: policyAllow, Match: PolicyMatch{Registry: "docker.io", Repository: "library/*", Tag: "1.*"}},
+			{Action: policyAllow, Match: PolicyMatch{Platform: "linux/arm64"}},
+			{Action: policyAllow, Match: PolicyMatch{Digest: digest}},
+			{Action: policyAllow, Match: PolicyMatch{Image: `^quay\.io/`}},
+		},
+		Default: policyDeny,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved := func(platform string, labels map[string]string) *resolution {
+		pl, _ := parsePlatform(platform)
+		return &resolution{platform: *pl, labels: labels}
+	}
+	for _, tc := range []struct {
+		image string
+		res   *resolution
+		allow bool
+		// ok is false when the decision needs the resolution
+		ok   bool
+		rule int
+	}{
+		// The first matching rule decides
+		{image: "ghcr.io/ourorg/private/site:v1", allow: false, ok: true, rule: 1},
+		{image: "ghcr.io/ourorg/site:v1", allow: true, ok: true, rule: 2},
+		{image: "ghcr.io/ourorg/team/site", allow: true, ok: true, rule: 2},
+		// ** crosses / while * doesn't
+		{image: "docker.io/library/nginx:1.21", res: resolved("linux/amd64", nil), allow: true, ok: true, rule: 4},
+		{image: "nginx:1.21", res: resolved("linux/amd64", nil), allow: true, ok: true, rule: 4},
+		{image: "docker.io/library/team/nginx:1.21", res: resolved("linux/amd64", nil), allow: false, ok: true},
+		{image: "nginx:latest", res: resolved("linux/amd64", nil), allow: false, ok: true},
+
+		// Labels and platforms need the resolution
+		{image: "docker.io/someone/site:v1", allow: false, ok: false},
+		{image: "docker.io/someone/site:v1", res: resolved("linux/amd64", map[string]string{"org.example.blocked": "yes"}), allow: false, ok: true, rule: 3},
+		{image: "docker.io/someone/site:v1", res: resolved("linux/arm64/v8", nil), allow: true, ok: true, rule: 5},
+		{image: "docker.io/someone/site:v1", res: resolved("linux/amd64", nil), allow: false, ok: true},
+
+		// Digests are known from digest references only
+		{image: "docker.io/someone/site@" + digest, res: resolved("linux/amd64", nil), allow: true, ok: true, rule: 6},
+		{image: "quay.io/someone/site:v1", res: resolved("linux/amd64", nil), allow: true, ok: true, rule: 7},
+	} {
+		ref, err := name.ParseReference(tc.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allow, rule, ok := p.decide(tc.image, ref, tc.res)
+		if allow != tc.allow || ok != tc.ok {
+			t.Errorf("%s: expected allow=%t ok=%t, got allow=%t ok=%t", tc.image, tc.allow, tc.ok, allow, ok)
+			continue
+		}
+		n := 0
+		for i, r := range p.rules {
+			if r == rule {
+				n = i + 1
+			}
+		}
+		if n != tc.rule {
+			t.Errorf("%s: expected rule %d, got %d", tc.image, tc.rule, n)
+		}
+	}
+}
+
+func TestPolicyDigestResolved(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("b", 64)
+	p, err := compilePolicy(&Policy{Rules: []PolicyRule{{Action: policyDeny, Match: PolicyMatch{Digest: digest}}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, _ := name.ParseReference("ghcr.io/org/site:v1")
+	if _, _, ok := p.decide("ghcr.io/org/site:v1", ref, nil); ok {
+		t.Error("expected the digest of a tag to need the resolution")
+	}
+	h, _ := v1.NewHash(digest)
+	if allow, _, ok := p.decide("ghcr.io/org/site:v1", ref, &resolution{digest: h}); allow || !ok {
+		t.Errorf("expected the resolved digest to be denied, got allow=%t ok=%t", allow, ok)
+	}
+}
+
+func TestPolicyWhitelist(t *testing.T) {
+	p, err := compilePolicy(nil, []string{`^ghcr\.io/ourorg/`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for image, want := range map[string]bool{
+		"ghcr.io/ourorg/site:v1":  true,
+		"ghcr.io/someone/site:v1": false,
+	} {
+		ref, _ := name.ParseReference(image)
+		if allow, _, _ := p.decide(image, ref, nil); allow != want {
+			t.Errorf("%s: expected allow=%t", image, want)
+		}
+	}
+
+	// Without rules nor whitelist everything is allowed
+	p, _ = compilePolicy(nil, nil)
+	ref, _ := name.ParseReference("ghcr.io/someone/site:v1")
+	if allow, _, ok := p.decide("ghcr.io/someone/site:v1", ref, nil); !allow || !ok {
+		t.Error("expected images to be allowed by default")
+	}
+}
+
+func TestCompilePolicyErrors(t *testing.T) {
+	for _, p := range []*Policy{
+		{Default: "maybe"},
+		{Rules: []PolicyRule{{Action: "maybe"}}},
+		{Rules: []PolicyRule{{Action: policyAllow, Match: PolicyMatch{Image: "("}}}},
+		{Rules: []PolicyRule{{Action: policyAllow, Match: PolicyMatch{Repository: "[a"}}}},
+		{Rules: []PolicyRule{{Action: policyAllow, Match: PolicyMatch{Platform: "linux"}}}},
+		{Rules: []PolicyRule{{Action: policyAllow, MaxSize: "big"}}},
+		{Rules: []PolicyRule{{Action: policyAllow, Auth: &Credential{}}}},
+	} {
+		if _, err := compilePolicy(p, nil); err == nil {
+			t.Errorf("expected an error for %+v", p)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+	"github.com/pterm/pterm"
+	"golang.org/x/sync/singleflight"
+)
+
+// resolution is the outcome of resolving an image reference
+// against its registry
+type resolution struct {
+	// ref is the digest reference the image resolved to,
+	// downloads are pinned to it so a moving tag can't
+	// change the content behind a cache key
+	ref    name.Digest
+	digest v1.Hash
+	size   int64
+
+	// platform is the platform of the resolved image, platforms
+	// the ones available if the reference points to an index
+	platform  v1.Platform
+	platforms []v1.Platform
+	// index is the digest of the index the image
+	// was resolved from, if any
+	index v1.Hash
+	// labels are the labels of the resolved image config
+	labels map[string]string
+	// layers are the digests of the resolved image layers
+	layers []v1.Hash
+	// noMatch is set when the reference is an index with
+	// no image for the requested platform
+	noMatch bool
+
+	err     error
+	expires time.Time
+}
+
+// resolveCache keeps tag to digest resolutions in memory,
+// so that serving cached content doesn't hit the registry
+// on every request. Only the most recently used are kept
+type resolveCache struct {
+	sync.Mutex
+	entries lruCache
+
+	ttl, negativeTTL time.Duration
+	stale            bool
+
+	group singleflight.Group
+}
+
+func (r *resolveCache) get(image string) (*resolution, bool) {
+	r.Lock()
+	defer r.Unlock()
+	res, ok := r.entries.get(image)
+	if !ok {
+		return nil, false
+	}
+	return res.(*resolution), true
+}
+
+func (r *resolveCache) set(image string, res *resolution) {
+	r.Lock()
+	defer r.Unlock()
+	r.entries.set(image, res)
+}
+
+// lookup returns the resolution for image, calling fetch when
+// there isn't a valid one in cache. Concurrent lookups of
+// the same image share a single registry call.
+func (r *resolveCache) lookup(image string, fetch func(string) *resolution) (*resolution, error) {
+	cached, ok := r.get(image)
+	if ok && time.Now().Before(cached.expires) {
+		return cached, cached.err
+	}
+
+	// Serve what we have and refresh it behind the scenes
+	if ok && r.stale && cached.err == nil {
+		go r.refresh(image, fetch)
+		return cached, nil
+	}
+
+	res := r.refresh(image, fetch)
+	return res, res.err
+}
+
+// unreachable returns true if err is the registry being unreachable, failing
+// or rate limiting us, rather than an answer about the image like not found
+func unreachable(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return true
+	}
+	return terr.StatusCode >= http.StatusInternalServerError || terr.StatusCode == http.StatusTooManyRequests
+}
+
+// refresh fetches a new resolution for image and stores it in
+// the cache. If the registry is unreachable and stale mode is enabled,
+// the last good resolution is kept and returned instead, retrying after
+// negativeTTL so an outage isn't hit on every request.
+func (r *resolveCache) refresh(image string, fetch func(string) *resolution) *resolution {
+	v, _, _ := r.group.Do(image, func() (interface{}, error) {
+		res := fetch(image)
+		if res.err != nil {
+			if cached, ok := r.get(image); ok && r.stale && cached.err == nil && unreachable(res.err) {
+				pterm.Warning.Printfln("Failed resolving '%s', serving stale digest %s: %s", image, cached.digest, res.err.Error())
+				stale := *cached
+				stale.expires = time.Now().Add(r.negativeTTL)
+				r.set(image, &stale)
+				return &stale, nil
+			}
+			res.expires = time.Now().Add(r.negativeTTL)
+		} else {
+			res.expires = time.Now().Add(r.ttl)
+		}
+		r.set(image, res)
+		return res, nil
+	})
+	return v.(*resolution)
+}
+
+// fetchResolution resolves image for platform against the remote registry.
+// If platform is nil, linux/amd64 is picked from indexes
+func (a *API) fetchResolution(image string, platform *v1.Platform) *resolution {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return &resolution{err: err}
+	}
+
+	desc, err := remote.Get(ref, a.remoteOptions()...)
+	if err != nil {
+		return &resolution{err: err}
+	}
+
+	res := &resolution{}
+	var img v1.Image
+	if desc.MediaType.IsIndex() {
+		want := v1.Platform{OS: "linux", Architecture: "amd64"}
+		if platform != nil {
+			want = *platform
+		}
+
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return &resolution{err: err}
+		}
+		manifest, err := idx.IndexManifest()
+		if err != nil {
+			return &resolution{err: err}
+		}
+
+		var child *v1.Descriptor
+		for i, m := range manifest.Manifests {
+			if m.Platform == nil {
+				continue
+			}
+			res.platforms = append(res.platforms, *m.Platform)
+			if child == nil && platformMatches(want, *m.Platform) {
+				child = &manifest.Manifests[i]
+			}
+		}
+		// The index digest is set without a match too, so it can be denylisted
+		res.index = desc.Digest
+		if child == nil {
+			res.noMatch = true
+			return res
+		}
+
+		res.platform = *child.Platform
+		img, err = remote.Image(ref.Context().Digest(child.Digest.String()), a.remoteOptions()...)
+		if err != nil {
+			return &resolution{err: err}
+		}
+	} else {
+		img, err = desc.Image()
+		if err != nil {
+			return &resolution{err: err}
+		}
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return &resolution{err: err}
+	}
+	if res.index == (v1.Hash{}) {
+		res.platform = v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture}
+	}
+	res.labels = cfg.Config.Labels
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return &resolution{err: err}
+	}
+	for _, l := range manifest.Layers {
+		res.layers = append(res.layers, l.Digest)
+	}
+
+	h, err := img.Digest()
+	if err != nil {
+		return &resolution{err: err}
+	}
+
+	res.ref = ref.Context().Digest(h.String())
+	res.digest = h
+	res.size = imageSize(img)
+	return res
+}
+
+// indexDigest returns the digest of the index the
+// image was resolved from, if any
+func (r *resolution) indexDigest() string {
+	if r.index == (v1.Hash{}) {
+		return ""
+	}
+	return r.index.String()
+}
+
+func (r *resolution) layerDigests() (layers []string) {
+	for _, l := range r.layers {
+		layers = append(layers, l.String())
+	}
+	return
+}
+
+// digests returns the manifest and layer digests of the resolved image
+func (r *resolution) digests() []string {
+	return append([]string{r.digest.String(), r.indexDigest()}, r.layerDigests()...)
+}
+
+// key returns the store key the resolved image is stored with
+func (r *resolution) key() string {
+	return storeKey(r.digest, r.platform)
+}
+
+// resolveImage returns the digest and size of image for platform, going to the
+// registry only when there isn't a valid resolution in cache
+func (a *API) resolveImage(image string, platform *v1.Platform) (*resolution, error) {
+	key := image
+	if platform != nil {
+		key += "|" + platformString(*platform)
+	}
+	return a.resolver.lookup(key, func(string) *resolution {
+		return a.fetchResolution(image, platform)
+	})
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestResolveCacheStaleBackoff(t *testing.T) {
+	r := &resolveCache{ttl: time.Millisecond, negativeTTL: time.Hour, stale: true}
+	good := &resolution{digest: v1.Hash{Algorithm: "sha256", Hex: "abc"}}
+	if _, err := r.lookup("img", func(string) *resolution { return good }); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	var calls int32
+	failing := func(string) *resolution {
+		atomic.AddInt32(&calls, 1)
+		return &resolution{err: errors.New("registry down")}
+	}
+	// The first lookup past the TTL refreshes in the background
+	res, err := r.lookup("img", failing)
+	if err != nil || res.digest != good.digest {
+		t.Fatalf("expected the stale resolution, got %v %v", res, err)
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&calls) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		res, err := r.lookup("img", failing)
+		if err != nil || res.digest != good.digest {
+			t.Fatalf("expected the stale resolution, got %v %v", res, err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected 1 registry call during the outage, got %d", n)
+	}
+}
+
+func TestResolveCacheStaleUnreachable(t *testing.T) {
+	good := &resolution{digest: v1.Hash{Algorithm: "sha256", Hex: "abc"}}
+	for _, tc := range []struct {
+		err   error
+		stale bool
+	}{
+		{err: errors.New("dial tcp: connection refused"), stale: true},
+		{err: &transport.Error{StatusCode: http.StatusServiceUnavailable}, stale: true},
+		{err: &transport.Error{StatusCode: http.StatusTooManyRequests}, stale: true},
+		// The image was deleted or made private
+		{err: &transport.Error{StatusCode: http.StatusNotFound}},
+		{err: &transport.Error{StatusCode: http.StatusUnauthorized}},
+		{err: &transport.Error{StatusCode: http.StatusForbidden}},
+	} {
+		r := &resolveCache{ttl: time.Hour, negativeTTL: time.Hour, stale: true}
+		r.lookup("img", func(string) *resolution { return good })
+
+		res := r.refresh("img", func(string) *resolution { return &resolution{err: tc.err} })
+		if stale := res.err == nil; stale != tc.stale {
+			t.Errorf("%v: expected stale=%t, got %+v", tc.err, tc.stale, res)
+		}
+		if _, err := r.lookup("img", nil); (err == nil) != tc.stale {
+			t.Errorf("%v: expected the cached entry to be stale=%t, got %v", tc.err, tc.stale, err)
+		}
+	}
+}
+
+func TestResolveCacheNegative(t *testing.T) {
+	r := &resolveCache{ttl: time.Hour, negativeTTL: time.Hour}
+	calls := 0
+	failing := func(string) *resolution {
+		calls++
+		return &resolution{err: errors.New("not found")}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := r.lookup("missing", failing); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected the failure to be cached, got %d calls", calls)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := &lruCache{size: 3}
+	for i := 0; i < 3; i++ {
+		c.set(fmt.Sprint(i), i)
+	}
+	// 0 is used, so 1 is the least recently used
+	if v, ok := c.get("0"); !ok || v.(int) != 0 {
+		t.Fatalf("expected 0, got %v %t", v, ok)
+	}
+	c.set("3", 3)
+	c.set("0", 10)
+
+	if c.len() != 3 {
+		t.Fatalf("expected 3 entries, got %d", c.len())
+	}
+	if _, ok := c.get("1"); ok {
+		t.Fatal("expected 1 to be evicted")
+	}
+	for k, want := range map[string]int{"0": 10, "2": 2, "3": 3} {
+		if v, ok := c.get(k); !ok || v.(int) != want {
+			t.Fatalf("expected %s=%d, got %v %t", k, want, v, ok)
+		}
+	}
+}
+
+func TestLRUCacheDefaultSize(t *testing.T) {
+	c := &lruCache{}
+	for i := 0; i < defaultCacheEntries+10; i++ {
+		c.set(fmt.Sprint(i), i)
+	}
+	if c.len() != defaultCacheEntries {
+		t.Fatalf("expected %d entries, got %d", defaultCacheEntries, c.len())
+	}
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/pterm/pterm"
+)
+
+// Route serves an image for a host, optionally
+// only under a path prefix
+type Route struct {
+	// Host is a host name, or a wildcard matching
+	// its subdomains, e.g. *.example.com
+	Host string `json:"host"`
+	// Path is the prefix the image is served under, / if empty
+	Path  string `json:"path,omitempty"`
+	Image string `json:"image"`
+	// Platform is the platform to serve for multi-arch images
+	Platform string `json:"platform,omitempty"`
+	// Root is the directory of the image served as web root, / if empty
+	Root string `json:"root,omitempty"`
+	// SPA serves the image as a single page application
+	SPA bool `json:"spa,omitempty"`
+}
+
+type route struct {
+	Route
+	platform *v1.Platform
+}
+
+// compile validates r and normalizes its host and path
+func (r Route) compile() (*route, error) {
+	if r.Host == "" {
+		return nil, errors.New("host is required")
+	}
+	if r.Image == "" {
+		return nil, errors.New("image is required")
+	}
+	if _, err := name.ParseReference(r.Image); err != nil {
+		return nil, errors.Wrapf(err, "invalid image '%s'", r.Image)
+	}
+	if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+		return nil, errors.Errorf("invalid path '%s', it must start with /", r.Path)
+	}
+
+	res := &route{Route: r}
+	res.Host = normalizeHost(r.Host)
+	res.Path = "/" + strings.Trim(r.Path, "/")
+	if r.Root != "" {
+		res.Root = path.Clean("/" + r.Root)
+	}
+	if r.Platform != "" {
+		p, err := parsePlatform(r.Platform)
+		if err != nil {
+			return nil, err
+		}
+		res.platform = p
+	}
+	return res, nil
+}
+
+// normalizeHost lowercases host and strips its port and trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (r *route) matchesHost(host string) bool {
+	if strings.HasPrefix(r.Host, "*.") {
+		return strings.HasSuffix(host, r.Host[1:])
+	}
+	return r.Host == host
+}
+
+func (r *route) matchesPath(path string) bool {
+	return r.Path == "/" || path == r.Path || strings.HasPrefix(path, r.Path+"/")
+}
+
+func compileRoutes(routes []Route) ([]*route, error) {
+	res := []*route{}
+	for i, r := range routes {
+		compiled, err := r.compile()
+		if err != nil {
+			return nil, errors.Wrapf(err, "route %d", i+1)
+		}
+		res = append(res, compiled)
+	}
+	return res, nil
+}
+
+// routeTable maps hosts and paths to images, reloading
+// them from the configuration file when it changes
+type routeTable struct {
+	sync.RWMutex
+	file   string
+	inline []Route
+
+	routes []*route
+}
+
+// load compiles the routes of the configuration file, or
+// the inline ones if there is no file
+func (t *routeTable) load() error {
+	routes := t.inline
+	if t.file != "" {
+		cfg, err := LoadConfig(t.file)
+		if err != nil {
+			return err
+		}
+		routes = cfg.Routes
+	}
+
+	compiled, err := compileRoutes(routes)
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.routes = compiled
+	return nil
+}
+
+// lookup returns the route for host and path. Exact hosts win over
+// wildcards, then the longest matching path wins
+func (t *routeTable) lookup(host, path string) (*route, bool) {
+	host = normalizeHost(host)
+
+	t.RLock()
+	defer t.RUnlock()
+
+	var match *route
+	matchExact := false
+	for _, r := range t.routes {
+		if !r.matchesHost(host) || !r.matchesPath(path) {
+			continue
+		}
+		exact := r.Host == host
+		if match == nil || (exact && !matchExact) || (exact == matchExact && len(r.Path) > len(match.Path)) {
+			match, matchExact = r, exact
+		}
+	}
+	return match, match != nil
+}
+
+func (t *routeTable) len() int {
+	t.RLock()
+	defer t.RUnlock()
+	return len(t.routes)
+}
+
+// serveRoutes serves the requests matching the routing table,
+// before any other lookup
+func (a *API) serveRoutes(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if strings.HasPrefix(req.URL.Path, "/_containerbay/") {
+			return next(c)
+		}
+		r, ok := a.routes.lookup(req.Host, req.URL.Path)
+		if !ok {
+			return next(c)
+		}
+
+		if r.Path != "/" && req.URL.Path == r.Path {
+			u := *req.URL
+			u.Path += "/"
+			return c.Redirect(http.StatusMovedPermanently, u.RequestURI())
+		}
+
+		pterm.Debug.Printfln("Route '%s%s' resolved '%s'", r.Host, r.Path, r.Image)
+		strip := r.Path
+		if strip != "/" {
+			strip += "/"
+		}
+		return a.renderImage(c, site{image: r.Image, platform: r.platform, root: r.Root, spa: r.SPA}, strip)
+	}
+}
@@ -0,0 +1,330 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/pterm/pterm"
+)
+
+const (
+	redirectsFile = "_redirects"
+	headersFile   = "_headers"
+)
+
+// siteRules are the redirects and headers of a site, from the
+// _redirects and _headers files at its root, as in Netlify
+type siteRules struct {
+	Redirects []redirectRule `json:"redirects,omitempty"`
+	Headers   []headerRule   `json:"headers,omitempty"`
+}
+
+// redirectRule redirects the paths matching From to To. Status 200
+// rewrites the path instead, and 404 serves To as not found. Unless
+// forced, the rule doesn't apply to the paths of existing files
+type redirectRule struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Status int    `json:"status"`
+	Force  bool   `json:"force,omitempty"`
+}
+
+// headerRule sets Headers on the responses to the paths matching Path
+type headerRule struct {
+	Path    string      `json:"path"`
+	Headers http.Header `json:"headers"`
+}
+
+// matchPath matches p against pattern, where :name matches a segment
+// and a trailing * the rest of the path, returned as splat
+func matchPath(pattern, p string) (map[string]string, bool) {
+	patterns := strings.Split(strings.Trim(pattern, "/"), "/")
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+
+	params := map[string]string{}
+	for i, s := range patterns {
+		if s == "*" && i == len(patterns)-1 {
+			params["splat"] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		switch {
+		case strings.HasPrefix(s, ":"):
+			params[s[1:]] = segments[i]
+		case s != segments[i]:
+			return nil, false
+		}
+	}
+	return params, len(patterns) == len(segments)
+}
+
+// target returns To with the placeholders replaced by params
+func (r redirectRule) target(params map[string]string) string {
+	names := []string{}
+	for k := range params {
+		names = append(names, k)
+	}
+	// Longer names first, so :id doesn't replace the start of :identifier
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+
+	to := r.To
+	for _, k := range names {
+		to = strings.ReplaceAll(to, ":"+k, params[k])
+	}
+	return to
+}
+
+func (r redirectRule) external() bool {
+	return strings.Contains(r.To, "://")
+}
+
+// redirect returns the first rule matching p
+func (s *siteRules) redirect(p string) (redirectRule, map[string]string, bool) {
+	for _, r := range s.Redirects {
+		if params, ok := matchPath(r.From, p); ok {
+			return r, params, true
+		}
+	}
+	return redirectRule{}, nil, false
+}
+
+// setHeaders sets the headers of all the rules matching p
+func (s *siteRules) setHeaders(h http.Header, p string) {
+	for _, r := range s.Headers {
+		if _, ok := matchPath(r.Path, p); !ok {
+			continue
+		}
+		for k, values := range r.Headers {
+			for _, v := range values {
+				h.Add(k, v)
+			}
+		}
+	}
+}
+
+// parseRedirects parses a _redirects file, where each line is:
+//
+//	/from /to [status][!]
+//
+// Invalid or unsupported rules are skipped
+func parseRedirects(r io.Reader, file string) []redirectRule {
+	rules := []redirectRule{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRedirect(strings.Fields(line))
+		if err != nil {
+			pterm.Warning.Printfln("Skipping rule at '%s:%d': %s", file, n, err.Error())
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func parseRedirect(fields []string) (redirectRule, error) {
+	if len(fields) < 2 {
+		return redirectRule{}, errors.New("expected a source and a destination")
+	}
+	if len(fields) > 3 {
+		return redirectRule{}, errors.New("conditions are not supported")
+	}
+	r := redirectRule{From: fields[0], To: fields[1], Status: http.StatusMovedPermanently}
+	if !strings.HasPrefix(r.From, "/") {
+		return r, errors.Errorf("invalid source '%s', it must be a path", r.From)
+	}
+	if !strings.HasPrefix(r.To, "/") && !r.external() {
+		return r, errors.Errorf("invalid destination '%s'", r.To)
+	}
+
+	if len(fields) == 3 {
+		status := fields[2]
+		if strings.HasSuffix(status, "!") {
+			r.Force = true
+			status = strings.TrimSuffix(status, "!")
+		}
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return r, errors.Errorf("invalid status '%s'", fields[2])
+		}
+		r.Status = code
+	}
+
+	switch r.Status {
+	case http.StatusOK, http.StatusNotFound:
+		if r.external() {
+			return r, errors.New("proxying to external URLs is not supported")
+		}
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return r, errors.Errorf("unsupported status %d", r.Status)
+	}
+	return r, nil
+}
+
+// parseHeaders parses a _headers file, made of paths followed
+// by the indented headers to set for them:
+//
+//	/assets/*
+//	  Cache-Control: public, max-age=31536000
+func parseHeaders(r io.Reader, file string) []headerRule {
+	rules := []headerRule{}
+	var current *headerRule
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "/"):
+			rules = append(rules, headerRule{Path: line, Headers: http.Header{}})
+			current = &rules[len(rules)-1]
+		case current != nil && strings.Contains(line, ":"):
+			kv := strings.SplitN(line, ":", 2)
+			current.Headers.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		default:
+			pterm.Warning.Printfln("Skipping invalid line at '%s:%d'", file, n)
+		}
+	}
+	return rules
+}
+
+// loadSiteRules parses the _redirects and _headers files of the site
+// served from dir, returning nil if there are none
+func loadSiteRules(dir string) (*siteRules, error) {
+	fs := rootFileSystem(dir)
+	rules := &siteRules{}
+	for _, name := range []string{redirectsFile, headersFile} {
+		f, err := fs.Open("/" + name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if st, err := f.Stat(); err != nil || !st.Mode().IsRegular() {
+			continue
+		}
+		if name == redirectsFile {
+			rules.Redirects = parseRedirects(f, name)
+		} else {
+			rules.Headers = parseHeaders(f, name)
+		}
+	}
+	if len(rules.Redirects) == 0 && len(rules.Headers) == 0 {
+		return nil, nil
+	}
+	return rules, nil
+}
+
+// siteRoot returns the root of the site served from dir, in the image extracted in base
+func siteRoot(base, dir string) string {
+	rel, err := filepath.Rel(base, dir)
+	if err != nil {
+		return "/"
+	}
+	return path.Clean("/" + filepath.ToSlash(rel))
+}
+
+// rulesCache keeps the rules of the sites served, by store key and root
+type rulesCache struct {
+	sync.Mutex
+	entries lruCache
+}
+
+// siteRulesFor returns the rules of the site served from dir, in the image
+// stored at key. They are decoded from the index, or parsed if the root
+// wasn't served when the image was extracted, only once
+func (a *API) siteRulesFor(key, dir string) *siteRules {
+	root := siteRoot(a.cacheStore.Path(key), dir)
+	id := key + ":" + root
+
+	a.rules.Lock()
+	v, ok := a.rules.entries.get(id)
+	a.rules.Unlock()
+	if ok {
+		return v.(*siteRules)
+	}
+
+	var rules *siteRules
+	found := false
+	stored := map[string]*siteRules{}
+	if e, ok := a.cacheStore.Get(key); ok && len(e.Meta) > 0 && json.Unmarshal(e.Meta, &stored) == nil {
+		rules, found = stored[root]
+	}
+	if !found {
+		var err error
+		if rules, err = loadSiteRules(dir); err != nil {
+			pterm.Warning.Printfln("Failed loading the rules of '%s': %s", dir, err.Error())
+		}
+	}
+
+	a.rules.Lock()
+	a.rules.entries.set(id, rules)
+	a.rules.Unlock()
+	return rules
+}
+
+// exists returns true if name is a file of fs, or a directory with an index
+func exists(fs http.FileSystem, name string) bool {
+	f, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return !st.IsDir() || exists(fs, path.Join(name, "index.html"))
+}
+
+// serveRewrite serves the file name of fs, or its index
+// if it is a directory, with the given status
+func (a *API) serveRewrite(c echo.Context, fs http.FileSystem, name string, code int) error {
+	name = path.Clean("/" + strings.SplitN(name, "?", 2)[0])
+	f, err := fs.Open(name)
+	if err == nil {
+		if st, serr := f.Stat(); serr == nil && st.IsDir() {
+			f.Close()
+			name = path.Join(name, "index.html")
+			f, err = fs.Open(name)
+		}
+	}
+	if err != nil {
+		return a.renderError(c, newHTTPError(http.StatusNotFound, "'%s' not found", name), fs)
+	}
+	defer f.Close()
+
+	if code == http.StatusOK {
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		http.ServeContent(c.Response(), c.Request(), name, st.ModTime(), f)
+		return nil
+	}
+	ct := mime.TypeByExtension(path.Ext(name))
+	if ct == "" {
+		ct = echo.MIMEOctetStream
+	}
+	return c.Stream(code, ct, f)
+}
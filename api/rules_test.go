@@ -0,0 +1,241 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mudler/containerbay/store"
+)
+
+func TestMatchPath(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		params        map[string]string
+	}{
+		{pattern: "/old", path: "/old", params: map[string]string{}},
+		{pattern: "/old", path: "/old/", params: map[string]string{}},
+		{pattern: "/old", path: "/older"},
+		{pattern: "/old", path: "/old/page"},
+		{pattern: "/blog/:year/:slug", path: "/blog/2024/hello", params: map[string]string{"year": "2024", "slug": "hello"}},
+		{pattern: "/blog/:year/:slug", path: "/blog/2024"},
+		{pattern: "/blog/:year/:slug", path: "/blog/2024/hello/world"},
+		{pattern: "/docs/*", path: "/docs/a/b", params: map[string]string{"splat": "a/b"}},
+		{pattern: "/docs/*", path: "/docs", params: map[string]string{"splat": ""}},
+		{pattern: "/docs/*", path: "/other/a"},
+		{pattern: "/*", path: "/", params: map[string]string{"splat": ""}},
+		{pattern: "/:lang/docs/*", path: "/en/docs/a", params: map[string]string{"lang": "en", "splat": "a"}},
+		// Only a trailing * is a splat
+		{pattern: "/*/docs", path: "/a/docs"},
+		{pattern: "/*/docs", path: "/*/docs", params: map[string]string{}},
+	} {
+		params, ok := matchPath(tc.pattern, tc.path)
+		if ok != (tc.params != nil) || (ok && !reflect.DeepEqual(params, tc.params)) {
+			t.Errorf("%s %s: expected %v, got %v %t", tc.pattern, tc.path, tc.params, params, ok)
+		}
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	for _, tc := range []struct {
+		to     string
+		params map[string]string
+		want   string
+	}{
+		{to: "/new", want: "/new"},
+		{to: "/posts/:year-:slug.html", params: map[string]string{"year": "2024", "slug": "hello"}, want: "/posts/2024-hello.html"},
+		{to: "https://example.com/:splat", params: map[string]string{"splat": "a/b"}, want: "https://example.com/a/b"},
+		// Longer names are replaced first
+		{to: "/:identifier/:id", params: map[string]string{"id": "1", "identifier": "x"}, want: "/x/1"},
+		{to: "/:missing", params: map[string]string{}, want: "/:missing"},
+	} {
+		if got := (redirectRule{To: tc.to}).target(tc.params); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.to, tc.want, got)
+		}
+	}
+}
+
+func TestParseRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		rule redirectRule
+		err  bool
+	}{
+		{line: "/old /new", rule: redirectRule{From: "/old", To: "/new", Status: 301}},
+		{line: "/old /new 302", rule: redirectRule{From: "/old", To: "/new", Status: 302}},
+		{line: "/app/* /index.html 200", rule: redirectRule{From: "/app/*", To: "/index.html", Status: 200}},
+		{line: "/private/* /404.html 404!", rule: redirectRule{From: "/private/*", To: "/404.html", Status: 404, Force: true}},
+		{line: "/ext https://example.com 308!", rule: redirectRule{From: "/ext", To: "https://example.com", Status: 308, Force: true}},
+
+		{line: "/old", err: true},
+		{line: "old /new", err: true},
+		{line: "/old new", err: true},
+		{line: "/old /new abc", err: true},
+		{line: "/old /new 500", err: true},
+		{line: "/old /new 302 Country=it", err: true},
+		{line: "/proxy https://example.com 200", err: true},
+	} {
+		rule, err := parseRedirect(strings.Fields(tc.line))
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error %v", tc.line, err)
+			continue
+		}
+		if !tc.err && rule != tc.rule {
+			t.Errorf("%s: expected %+v, got %+v", tc.line, tc.rule, rule)
+		}
+	}
+}
+
+func TestRedirectFirstMatch(t *testing.T) {
+	rules := &siteRules{Redirects: parseRedirects(strings.NewReader(`
+# comments and invalid rules are skipped
+/invalid
+/blog/special /special.html
+/blog/* /posts/:splat 302
+/blog/special /never.html
+`), "_redirects")}
+	if len(rules.Redirects) != 3 {
+		t.Fatalf("expected 3 rules, got %+v", rules.Redirects)
+	}
+
+	for p, want := range map[string]string{
+		"/blog/special": "/special.html",
+		"/blog/a/b":     "/posts/a/b",
+	} {
+		r, params, ok := rules.redirect(p)
+		if !ok || r.target(params) != want {
+			t.Errorf("%s: expected %s, got %+v %t", p, want, r, ok)
+		}
+	}
+	if r, _, ok := rules.redirect("/other"); ok {
+		t.Errorf("expected no rule for /other, got %+v", r)
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	rules := &siteRules{Headers: parseHeaders(strings.NewReader(`
+/*
+  X-Frame-Options: DENY
+/assets/*
+  Cache-Control: public, max-age=31536000
+  X-Multi: a
+  X-Multi: b
+invalid line
+`), "_headers")}
+
+	h := http.Header{}
+	rules.setHeaders(h, "/assets/app.css")
+	want := http.Header{
+		"X-Frame-Options": {"DENY"},
+		"Cache-Control":   {"public, max-age=31536000"},
+		"X-Multi":         {"a", "b"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("expected %v, got %v", want, h)
+	}
+
+	h = http.Header{}
+	rules.setHeaders(h, "/index.html")
+	if !reflect.DeepEqual(h, http.Header{"X-Frame-Options": {"DENY"}}) {
+		t.Errorf("expected only X-Frame-Options, got %v", h)
+	}
+}
+
+// writeFiles writes files, by their path relative to dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for p, content := range files {
+		p = filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadSiteRules(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"_redirects":                    "/a /b\n",
+		"_headers":                      "/*\n  X-A: a\n",
+		"public/_redirects":             "/c /d 302\n",
+		"public/index.html":             "index",
+		"node_modules/module/_headers":  "/*\n  X-B: b\n",
+		"empty/_redirects":              "# nothing\n",
+		"dir/_redirects/not-a-file.txt": "",
+	})
+
+	rules, err := loadSiteRules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules == nil || len(rules.Redirects) != 1 || len(rules.Headers) != 1 || rules.Headers[0].Headers.Get("X-B") != "" {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+
+	rules, err = loadSiteRules(filepath.Join(dir, "public"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules == nil || rules.Redirects[0] != (redirectRule{From: "/c", To: "/d", Status: 302}) || len(rules.Headers) != 0 {
+		t.Fatalf("unexpected rules for /public %+v", rules)
+	}
+
+	for _, d := range []string{"empty", "dir", "missing"} {
+		if rules, err := loadSiteRules(filepath.Join(dir, d)); err != nil || rules != nil {
+			t.Errorf("%s: expected no rules, got %+v %v", d, rules, err)
+		}
+	}
+}
+
+func TestSiteRulesFor(t *testing.T) {
+	st := store.New(t.TempDir())
+	if err := st.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	if err := st.Begin(store.Entry{Key: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := st.Stage("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{
+		"_redirects":        "/disk /x\n",
+		"public/_redirects": "/c /d 302\n",
+	})
+	// The rules of the root are stored at extraction
+	meta, _ := json.Marshal(map[string]*siteRules{"/": {Redirects: []redirectRule{{From: "/a", To: "/b", Status: 301}}}})
+	if err := st.SetMeta("key", meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Commit("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &API{cacheStore: st}
+	if r := a.siteRulesFor("key", st.Path("key")); r == nil || r.Redirects[0].From != "/a" {
+		t.Errorf("expected the stored rules of /, got %+v", r)
+	}
+
+	// Other roots are parsed once
+	public := st.Path("key", "public")
+	if r := a.siteRulesFor("key", public); r == nil || r.Redirects[0].From != "/c" {
+		t.Errorf("expected the rules of /public, got %+v", r)
+	}
+	os.Remove(filepath.Join(public, redirectsFile))
+	if r := a.siteRulesFor("key", public); r == nil || r.Redirects[0].From != "/c" {
+		t.Errorf("expected the rules of /public to be cached, got %+v", r)
+	}
+	if r := a.siteRulesFor("key", st.Path("key", "other")); r != nil {
+		t.Errorf("expected no rules for /other, got %+v", r)
+	}
+}
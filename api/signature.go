@@ -0,0 +1,230 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+)
+
+const (
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	cosignSignatureType       = "cosign container image signature"
+)
+
+// signaturePolicy requires images matching pattern to be
+// signed by at least one of keys
+type signaturePolicy struct {
+	rawPattern string
+	keyPaths   []string
+
+	pattern *regexp.Regexp
+	keys    []crypto.PublicKey
+}
+
+// simpleSigning is the payload signed by cosign
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+type verification struct {
+	err     error
+	expires time.Time
+}
+
+// signatureVerifier verifies cosign signatures of images,
+// remembering the outcome for the most recently verified digests
+type signatureVerifier struct {
+	sync.Mutex
+	policies []*signaturePolicy
+	results  lruCache
+}
+
+// loadPublicKey reads a PEM encoded public key
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, errors.Errorf("no PEM data found in '%s'", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while parsing public key '%s'", path)
+	}
+	return key, nil
+}
+
+// load compiles the policies patterns and reads their keys
+func (s *signatureVerifier) load() error {
+	for _, p := range s.policies {
+		r, err := regexp.Compile(p.rawPattern)
+		if err != nil {
+			return err
+		}
+		p.pattern = r
+		p.keys = nil
+		for _, path := range p.keyPaths {
+			key, err := loadPublicKey(path)
+			if err != nil {
+				return err
+			}
+			p.keys = append(p.keys, key)
+		}
+	}
+	return nil
+}
+
+// keysFor returns the keys image must be signed with,
+// nil if it doesn't require signatures
+func (s *signatureVerifier) keysFor(image string) (keys []crypto.PublicKey) {
+	for _, p := range s.policies {
+		if p.pattern.MatchString(image) {
+			keys = append(keys, p.keys...)
+		}
+	}
+	return
+}
+
+// verifySignature checks that the resolved image is signed by one of keys. Either
+// the image or the index it was resolved from can be signed
+func verifySignature(res *resolution, keys []crypto.PublicKey, opts ...remote.Option) error {
+	digests := []v1.Hash{res.digest}
+	if res.index != (v1.Hash{}) {
+		digests = append(digests, res.index)
+	}
+
+	var reasons []string
+	for _, d := range digests {
+		err := verifyDigest(res.ref.Context(), d, keys, opts...)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	return errors.New(strings.Join(reasons, "; "))
+}
+
+// verifyDigest looks for a valid signature of d in the sha256-<hex>.sig tag of repo
+func verifyDigest(repo name.Repository, d v1.Hash, keys []crypto.PublicKey, opts ...remote.Option) error {
+	sigRef := repo.Tag(fmt.Sprintf("%s-%s.sig", d.Algorithm, d.Hex))
+	img, err := remote.Image(sigRef, opts...)
+	if err != nil {
+		return errors.Wrapf(err, "no signature found for %s", d)
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+
+	for _, l := range manifest.Layers {
+		encoded, ok := l.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+
+		layer, err := img.LayerByDigest(l.Digest)
+		if err != nil {
+			return err
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return err
+		}
+		payload, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+
+		p := simpleSigning{}
+		if err := json.Unmarshal(payload, &p); err != nil {
+			continue
+		}
+		if p.Critical.Type != cosignSignatureType || p.Critical.Image.DockerManifestDigest != d.String() {
+			continue
+		}
+
+		for _, k := range keys {
+			if verifyPayload(k, payload, sig) {
+				return nil
+			}
+		}
+	}
+
+	return errors.Errorf("no valid signature found for %s", d)
+}
+
+func verifyPayload(key crypto.PublicKey, payload, sig []byte) bool {
+	digest := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil ||
+			rsa.VerifyPSS(k, crypto.SHA256, digest[:], sig, nil) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	}
+	return false
+}
+
+// reset forgets the outcome of previous verifications
+func (s *signatureVerifier) reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.results = lruCache{}
+}
+
+// verify checks the signatures of the resolved image if required, by
+// the policies or by the extra keys given.
+// Successful verifications are remembered, failures for negativeTTL
+func (s *signatureVerifier) verify(image string, res *resolution, extra []crypto.PublicKey, negativeTTL time.Duration, opts ...remote.Option) error {
+	keys := append(s.keysFor(image), extra...)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	key := image + "@" + res.digest.String()
+	s.Lock()
+	v, ok := s.results.get(key)
+	s.Unlock()
+	if cached, _ := v.(verification); ok && (cached.err == nil || time.Now().Before(cached.expires)) {
+		return cached.err
+	}
+
+	err := verifySignature(res, keys, opts...)
+
+	s.Lock()
+	defer s.Unlock()
+	s.results.set(key, verification{err: err, expires: time.Now().Add(negativeTTL)})
+	return err
+}
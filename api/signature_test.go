@@ -0,0 +1,43 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestSignatureVerifierResults(t *testing.T) {
+	key, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []crypto.PublicKey{key}
+	res := func(hex string) *resolution {
+		return &resolution{digest: v1.Hash{Algorithm: "sha256", Hex: hex}}
+	}
+
+	s := &signatureVerifier{results: lruCache{size: 2}}
+	failed := errors.New("no matching signatures")
+	s.results.set("a@sha256:a", verification{err: failed, expires: time.Now().Add(time.Minute)})
+	s.results.set("b@sha256:b", verification{})
+	if err := s.verify("a", res("a"), keys, time.Minute); err != failed {
+		t.Errorf("expected the cached failure, got %v", err)
+	}
+	if err := s.verify("b", res("b"), keys, time.Minute); err != nil {
+		t.Errorf("expected the cached success, got %v", err)
+	}
+
+	s.results.set("c@sha256:c", verification{})
+	if _, ok := s.results.get("a@sha256:a"); ok || s.results.len() != 2 {
+		t.Errorf("expected the least recently verified digest to be evicted")
+	}
+
+	s.reset()
+	if s.results.len() != 0 {
+		t.Errorf("expected no results after reset")
+	}
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	str2duration "github.com/xhit/go-str2duration/v2"
+)
+
+const defaultProcessingPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.RetryAfter}}">
+<title>Building your site</title>
+</head>
+<body>
+<p>Building your site from <code>{{.Image}}</code>, this page will refresh in {{.RetryAfter}} seconds.</p>
+</body>
+</html>
+`
+
+type processingPage struct {
+	Image      string
+	RetryAfter int
+}
+
+func (a *API) loadProcessingPage() error {
+	var err error
+	if a.processingPage == "" {
+		a.processingTmpl, err = template.New("processing").Parse(defaultProcessingPage)
+		return err
+	}
+	a.processingTmpl, err = template.ParseFiles(a.processingPage)
+	return err
+}
+
+// requestWait returns how long the request is willing to wait for the image
+// to be ready, from the "wait" query parameter or the "Prefer: wait=<seconds>"
+// header (RFC 7240), falling back to the instance default
+func (a *API) requestWait(c echo.Context) time.Duration {
+	wait := a.wait
+
+	if q := c.QueryParam("wait"); q != "" {
+		if d, err := str2duration.ParseDuration(q); err == nil {
+			wait = d
+		} else if i, err := strconv.Atoi(q); err == nil {
+			wait = time.Duration(i) * time.Second
+		}
+	} else if d, ok := preferWait(c.Request().Header.Values("Prefer")); ok {
+		wait = d
+		if wait == 0 {
+			wait = a.maxWait
+		}
+	}
+
+	if wait > a.maxWait {
+		wait = a.maxWait
+	}
+	return wait
+}
+
+// preferWait parses the wait preference out of the Prefer headers.
+// A "wait" preference without value is returned as 0
+func preferWait(headers []string) (time.Duration, bool) {
+	for _, h := range headers {
+		for _, p := range strings.Split(h, ",") {
+			p = strings.TrimSpace(strings.SplitN(p, ";", 2)[0])
+			kv := strings.SplitN(p, "=", 2)
+			if !strings.EqualFold(strings.TrimSpace(kv[0]), "wait") {
+				continue
+			}
+			if len(kv) == 1 {
+				return 0, true
+			}
+			i, err := strconv.Atoi(strings.Trim(strings.TrimSpace(kv[1]), `"`))
+			if err != nil {
+				continue
+			}
+			return time.Duration(i) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// waitDownload waits for dl up to d, returning false if
+// it didn't complete in time
+func waitDownload(ctx context.Context, dl *download, d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-dl.Done():
+			return true
+		default:
+			return false
+		}
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-dl.Done():
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// retryAfterSeconds returns the seconds clients should retry after
+func (a *API) retryAfterSeconds() int {
+	return int(math.Ceil(a.retryAfter.Seconds()))
+}
+
+// processing replies that the image is still being prepared
+func (a *API) processing(c echo.Context, image string) error {
+	retry := a.retryAfterSeconds()
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retry))
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().WriteHeader(http.StatusAccepted)
+	return a.processingTmpl.Execute(c.Response(), processingPage{Image: image, RetryAfter: retry})
+}
+
+// busy replies that the image can't be downloaded now,
+// as the download queue is full
+func (a *API) busy(c echo.Context, image string) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(a.retryAfterSeconds()))
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return a.renderError(c, newHTTPError(http.StatusServiceUnavailable, "too many downloads in progress, can't download image '%s'", image), nil)
+}
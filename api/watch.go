@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pterm/pterm"
+)
+
+// reloadInterval is how often watched files
+// are checked for changes
+const reloadInterval = 5 * time.Second
+
+// fileWatch tracks the changes of a file
+type fileWatch struct {
+	file    string
+	modTime time.Time
+	size    int64
+}
+
+// changed returns true if the file changed since it was last checked
+func (w *fileWatch) changed() bool {
+	info, err := os.Stat(w.file)
+	if err != nil {
+		return false
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+	return true
+}
+
+// watchFile calls reload when file changes. If reload fails, what
+// was loaded before is expected to be kept
+func watchFile(ctx context.Context, file, what string, reload func() error) {
+	if file == "" {
+		return
+	}
+	w := &fileWatch{file: file}
+	w.changed()
+
+	go func() {
+		t := time.NewTicker(reloadInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if !w.changed() {
+					continue
+				}
+				if err := reload(); err != nil {
+					pterm.Error.Printfln("Failed reloading %s '%s', keeping the previous one: %s", what, file, err.Error())
+					continue
+				}
+				pterm.Info.Printfln("Reloaded %s '%s'", what, file)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
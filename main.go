@@ -6,11 +6,13 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/mholt/archiver/v3"
+	"github.com/moby/moby/api/types"
 	"github.com/mudler/containerbay/api"
 	"github.com/mudler/containerbay/internal"
 	terminal "github.com/mudler/go-isterminal"
@@ -21,6 +23,11 @@ import (
 )
 
 var flags = []cli.Flag{
+	&cli.StringFlag{
+		Name:   "config",
+		Usage:  "YAML configuration file, flags explicitly set override its values",
+		EnvVar: "CONTAINERBAY_CONFIG",
+	},
 	&cli.BoolFlag{
 		Name:   "gzip",
 		Usage:  "enable gzip",
@@ -42,28 +49,184 @@ var flags = []cli.Flag{
 		Usage:  "magic dns address",
 		EnvVar: "CONTAINERBAY_MAGICDNS",
 	},
+	&cli.StringFlag{
+		Name:   "dns-resolver",
+		Usage:  "address (ip:port) of the DNS server used to look up TXT records, defaults to the first nameserver of /etc/resolv.conf",
+		EnvVar: "CONTAINERBAY_DNS_RESOLVER",
+	},
+	&cli.StringFlag{
+		Name:   "dns-min-ttl",
+		Usage:  "minimum time TXT records are cached for",
+		EnvVar: "CONTAINERBAY_DNS_MIN_TTL",
+		Value:  "1m",
+	},
+	&cli.StringFlag{
+		Name:   "dns-max-ttl",
+		Usage:  "maximum time TXT records are cached for",
+		EnvVar: "CONTAINERBAY_DNS_MAX_TTL",
+		Value:  "1h",
+	},
+	&cli.BoolFlag{
+		Name:   "verify-domains",
+		Usage:  "require domains bound by TXT records to have a valid token, or to be allowed by the image label",
+		EnvVar: "CONTAINERBAY_VERIFY_DOMAINS",
+	},
+	&cli.StringFlag{
+		Name:   "domain-secret",
+		Usage:  "secret the domain verification tokens are derived from",
+		EnvVar: "CONTAINERBAY_DOMAIN_SECRET",
+	},
 	&cli.StringFlag{
 		Name:   "default-image",
 		Usage:  "Default image to use",
 		EnvVar: "CONTAINERBAY_DEFAULTIMAGE",
 		Value:  "ghcr.io/containerbay/containerbay.io:latest",
 	},
+	&cli.StringFlag{
+		Name:   "error-image",
+		Usage:  "image with the error pages (e.g. 404.html, 50x.html) served when the requested image doesn't have them",
+		EnvVar: "CONTAINERBAY_ERRORIMAGE",
+	},
 	&cli.StringSliceFlag{
 		Name:   "whitelist",
 		Usage:  "Regex list of images allowed",
 		EnvVar: "WHITELIST",
 	},
+	&cli.StringFlag{
+		Name:   "policy",
+		Usage:  "YAML or JSON file with the rules deciding which images can be served, reloaded on change",
+		EnvVar: "CONTAINERBAY_POLICY",
+	},
+	&cli.StringFlag{
+		Name:   "denylist",
+		Usage:  "file where blocked references and digests are persisted, defaults to the store directory",
+		EnvVar: "CONTAINERBAY_DENYLIST",
+	},
+	&cli.StringFlag{
+		Name:   "admin-token",
+		Usage:  "bearer token required by the admin endpoints, which are disabled if not set",
+		EnvVar: "CONTAINERBAY_ADMIN_TOKEN",
+	},
+	&cli.StringSliceFlag{
+		Name:   "verify",
+		Usage:  "Require images matching a regex to be signed with cosign by a public key, in the regex=/path/to/cosign.pub form",
+		EnvVar: "CONTAINERBAY_VERIFY",
+	},
 	&cli.StringFlag{
 		Name:   "cleanup",
 		Usage:  "store cleanup interval",
 		EnvVar: "CONTAINERBAY_CLEANUPINTERVAL",
 	},
+	&cli.StringFlag{
+		Name:   "resolve-ttl",
+		Usage:  "how long an image tag resolved to a digest is cached",
+		EnvVar: "CONTAINERBAY_RESOLVETTL",
+		Value:  "1m",
+	},
+	&cli.StringFlag{
+		Name:   "resolve-negative-ttl",
+		Usage:  "how long a failed image resolution is cached",
+		EnvVar: "CONTAINERBAY_RESOLVENEGATIVETTL",
+		Value:  "10s",
+	},
+	&cli.BoolFlag{
+		Name:   "stale-while-revalidate",
+		Usage:  "serve expired resolutions while refreshing them, and when the registry is unreachable",
+		EnvVar: "CONTAINERBAY_STALEWHILEREVALIDATE",
+	},
+	&cli.StringFlag{
+		Name:   "wait",
+		Usage:  "how long requests wait for an image to be ready, instead of replying it is still processing",
+		EnvVar: "CONTAINERBAY_WAIT",
+	},
+	&cli.StringFlag{
+		Name:   "max-wait",
+		Usage:  "max time a request can wait for an image to be ready",
+		EnvVar: "CONTAINERBAY_MAXWAIT",
+		Value:  "1m",
+	},
+	&cli.StringFlag{
+		Name:   "retry-after",
+		Usage:  "time after which clients are told to retry while an image is being processed",
+		EnvVar: "CONTAINERBAY_RETRYAFTER",
+		Value:  "5s",
+	},
+	&cli.StringFlag{
+		Name:   "processing-page",
+		Usage:  "HTML template rendered while an image is being processed",
+		EnvVar: "CONTAINERBAY_PROCESSINGPAGE",
+	},
+	&cli.BoolFlag{
+		Name:   "spa",
+		Usage:  "serve images as single page applications, missing paths without an extension serve index.html",
+		EnvVar: "CONTAINERBAY_SPA",
+	},
+	&cli.StringSliceFlag{
+		Name:   "labels",
+		Usage:  "image labels configuring how images are served to honor (root, spa, cache-control, cors, index), all by default, none to ignore them",
+		EnvVar: "CONTAINERBAY_LABELS",
+	},
+	&cli.StringFlag{
+		Name:   "root",
+		Usage:  "directory of the standalone image served as web root, e.g. /usr/share/nginx/html",
+		EnvVar: "CONTAINERBAY_ROOT",
+	},
+	&cli.StringFlag{
+		Name:   "platform",
+		Usage:  "default platform (os/arch[/variant]) to serve from multi-arch images",
+		EnvVar: "CONTAINERBAY_PLATFORM",
+	},
+	&cli.StringFlag{
+		Name:   "registry-username",
+		Usage:  "username to authenticate against registries",
+		EnvVar: "CONTAINERBAY_REGISTRYUSERNAME",
+	},
+	&cli.StringFlag{
+		Name:   "registry-password",
+		Usage:  "password to authenticate against registries",
+		EnvVar: "CONTAINERBAY_REGISTRYPASSWORD",
+	},
+	&cli.StringFlag{
+		Name:   "registry-token",
+		Usage:  "bearer token to authenticate against registries",
+		EnvVar: "CONTAINERBAY_REGISTRYTOKEN",
+	},
+	&cli.StringFlag{
+		Name:   "registry-server",
+		Usage:  "restrict the registry credentials to the given registry (e.g. ghcr.io)",
+		EnvVar: "CONTAINERBAY_REGISTRYSERVER",
+	},
+	&cli.StringFlag{
+		Name:   "credentials",
+		Usage:  "YAML or JSON file with the credentials for each registry",
+		EnvVar: "CONTAINERBAY_CREDENTIALS",
+	},
+	&cli.StringFlag{
+		Name:   "docker-config",
+		Usage:  "path of a docker config.json to read registry credentials from",
+		EnvVar: "CONTAINERBAY_DOCKERCONFIG",
+	},
+	&cli.BoolFlag{
+		Name:   "keychain",
+		Usage:  "read registry credentials from the default docker config and credential helpers",
+		EnvVar: "CONTAINERBAY_KEYCHAIN",
+	},
 	&cli.StringFlag{
 		Name:   "store",
 		Usage:  "cachestore directory",
 		EnvVar: "CONTAINERBAY_CACHEDIR",
 		Value:  "/tmp/containerbay",
 	},
+	&cli.StringFlag{
+		Name:   "store-max-size",
+		Usage:  "Max total size of the cachestore, least recently used images are evicted first",
+		EnvVar: "CONTAINERBAY_STOREMAXSIZE",
+	},
+	&cli.StringFlag{
+		Name:   "store-max-age",
+		Usage:  "Max time an image can stay in the cachestore without being accessed",
+		EnvVar: "CONTAINERBAY_STOREMAXAGE",
+	},
 	&cli.StringFlag{
 		Name:   "max-size",
 		Usage:  "Max imagesize to serve",
@@ -92,9 +255,9 @@ func (p *ptermWriter) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
-func echoConfig(c *cli.Context) func(e *echo.Echo) error {
+func echoConfig(gzip bool) func(e *echo.Echo) error {
 	return func(e *echo.Echo) error {
-		if c.Bool("gzip") {
+		if gzip {
 			e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
 				Level: 5,
 			}))
@@ -104,6 +267,150 @@ func echoConfig(c *cli.Context) func(e *echo.Echo) error {
 	}
 }
 
+// authConfig returns the registry credentials given from the CLI, if any
+func authConfig(c *cli.Context) *types.AuthConfig {
+	if c.String("registry-username") == "" && c.String("registry-password") == "" && c.String("registry-token") == "" {
+		return nil
+	}
+	return &types.AuthConfig{
+		Username:      c.String("registry-username"),
+		Password:      c.String("registry-password"),
+		RegistryToken: c.String("registry-token"),
+		ServerAddress: c.String("registry-server"),
+	}
+}
+
+// verifyOptions returns the signature verification options given from the CLI
+func verifyOptions(c *cli.Context) (opts []api.Options, err error) {
+	for _, v := range c.StringSlice("verify") {
+		i := strings.LastIndex(v, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid verify '%s', expected regex=/path/to/key.pub", v)
+		}
+		opts = append(opts, api.WithSignatureVerification(v[:i], v[i+1:]))
+	}
+	return
+}
+
+// flagOption is an API option given by one or more flags
+type flagOption struct {
+	flags []string
+	opts  []api.Options
+}
+
+func option(flag string, opts ...api.Options) flagOption {
+	return flagOption{flags: []string{flag}, opts: opts}
+}
+
+func (f flagOption) isSet(c *cli.Context) bool {
+	for _, name := range f.flags {
+		if c.IsSet(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate applies the options to an empty API, returning their first
+// error, as api.New doesn't fail on invalid options
+func (f flagOption) validate() error {
+	a := &api.API{}
+	for _, o := range f.opts {
+		if err := o(a); err != nil {
+			return errors.Wrapf(err, "invalid --%s", strings.Join(f.flags, ", --"))
+		}
+	}
+	return nil
+}
+
+// loadConfig returns the configuration file given from the CLI, if any
+func loadConfig(c *cli.Context) (*api.Config, error) {
+	if c.String("config") == "" {
+		return &api.Config{}, nil
+	}
+	return api.LoadConfig(c.String("config"))
+}
+
+// serverOptions returns the API options shared by the run and standalone commands.
+// Flags are defaults for the configuration file, unless explicitly set
+func serverOptions(c *cli.Context, cfg *api.Config, extra ...flagOption) ([]api.Options, error) {
+	verify, err := verifyOptions(c)
+	if err != nil {
+		return nil, err
+	}
+
+	flagOpts := []flagOption{
+		option("address", api.WithListeningAddress(c.String("address"))),
+		option("store", api.WithCacheStore(c.String("store"))),
+		option("store-max-size", api.WithStoreMaxSize(c.String("store-max-size"))),
+		option("store-max-age", api.WithStoreMaxAge(c.String("store-max-age"))),
+		option("dns", api.WithMagicDNS(c.String("dns"))),
+		option("dns-resolver", api.WithDNSResolver(c.String("dns-resolver"))),
+		option("dns-min-ttl", api.WithDNSMinTTL(c.String("dns-min-ttl"))),
+		option("dns-max-ttl", api.WithDNSMaxTTL(c.String("dns-max-ttl"))),
+		option("verify-domains", api.WithDomainVerification(c.Bool("verify-domains"))),
+		option("domain-secret", api.WithDomainSecret(c.String("domain-secret"))),
+		option("max-size", api.WithMaxSize(c.String("max-size"))),
+		option("workers", api.WithWorkers(c.Int("workers"))),
+		option("cleanup", api.WithCleanupInterval(c.String("cleanup"))),
+		option("resolve-ttl", api.WithResolveCacheTTL(c.String("resolve-ttl"))),
+		option("resolve-negative-ttl", api.WithNegativeCacheTTL(c.String("resolve-negative-ttl"))),
+		option("stale-while-revalidate", api.WithStaleWhileRevalidate(c.Bool("stale-while-revalidate"))),
+		option("wait", api.WithWait(c.String("wait"))),
+		option("max-wait", api.WithMaxWait(c.String("max-wait"))),
+		option("retry-after", api.WithRetryAfter(c.String("retry-after"))),
+		option("processing-page", api.WithProcessingPage(c.String("processing-page"))),
+		option("pool", api.WithPoolSize(c.Int("pool"))),
+		option("default-image", api.WithDefaultImage(c.String("default-image"))),
+		option("error-image", api.WithErrorImage(c.String("error-image"))),
+		option("root", api.WithRoot(c.String("root"))),
+		option("platform", api.WithPlatform(c.String("platform"))),
+		option("spa", api.WithSPA(c.Bool("spa"))),
+		option("labels", api.WithLabels(c.StringSlice("labels")...)),
+		{
+			flags: []string{"registry-username", "registry-password", "registry-token", "registry-server"},
+			opts:  []api.Options{api.WithAuth(authConfig(c))},
+		},
+		option("credentials", api.WithCredentialsFile(c.String("credentials"))),
+		option("docker-config", api.WithDockerConfig(c.String("docker-config"))),
+		option("keychain", api.WithDefaultKeychain(c.Bool("keychain"))),
+		option("policy", api.WithPolicyFile(c.String("policy"))),
+		option("denylist", api.WithDenylistFile(c.String("denylist"))),
+		option("admin-token", api.WithAdminToken(c.String("admin-token"))),
+		option("verify", verify...),
+	}
+
+	cfgOpts, err := cfg.Options()
+	if err != nil {
+		return nil, err
+	}
+	// Routes are reloaded from the configuration file when it changes
+	if c.String("config") != "" {
+		cfgOpts = append(cfgOpts, api.WithRoutesFile(c.String("config")))
+	}
+
+	var defaults, overrides []api.Options
+	for _, f := range append(flagOpts, extra...) {
+		if !f.isSet(c) {
+			defaults = append(defaults, f.opts...)
+			continue
+		}
+		if err := f.validate(); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, f.opts...)
+	}
+	return append(append(defaults, cfgOpts...), overrides...), nil
+}
+
+// boolFlag returns the value of a boolean flag if set, v otherwise
+func boolFlag(c *cli.Context, name string, v bool) bool {
+	if c.IsSet(name) {
+		return c.Bool(name)
+	}
+	return v
+}
+
 func startBanner() {
 	pterm.Info.Println("Starting Containerbay")
 }
@@ -187,24 +494,25 @@ $ containerbay standalone foo/image:tag
 `,
 				Usage: "run the daemon to serve only a single container image",
 				Action: func(c *cli.Context) error {
-					if !c.Args().Present() {
+					cfg, err := loadConfig(c)
+					if err != nil {
+						return err
+					}
+					if !c.Args().Present() && cfg.Standalone == "" {
 						return errors.New("need an image")
 					}
-					if c.Bool("debug") {
+					if boolFlag(c, "debug", cfg.Debug) {
 						pterm.EnableDebugMessages()
 					}
 					startBanner()
-					return api.New(
-						api.WithListeningAddress(c.String("address")),
-						api.WithMagicDNS(c.String("dns")),
-						api.WithCacheStore(c.String("store")),
-						api.Standalone(c.Args().First()),
-						api.WithMaxSize(c.String("max-size")),
-						api.WithWorkers(c.Int("workers")),
-						api.WithCleanupInterval(c.String("cleanup")),
-						api.WithPoolSize(c.Int("pool")),
-						api.WithDefaultImage(c.String("default-image")),
-					).Start(echoConfig(c))
+					opts, err := serverOptions(c, cfg)
+					if err != nil {
+						return err
+					}
+					if c.Args().Present() {
+						opts = append(opts, api.Standalone(c.Args().First()))
+					}
+					return api.New(opts...).Start(echoConfig(boolFlag(c, "gzip", cfg.Gzip)))
 				},
 			},
 			{
@@ -213,21 +521,95 @@ $ containerbay standalone foo/image:tag
 				Flags:   flags,
 				Usage:   "run the api to serve multiple container images",
 				Action: func(c *cli.Context) error {
-					if c.Bool("debug") {
+					cfg, err := loadConfig(c)
+					if err != nil {
+						return err
+					}
+					if boolFlag(c, "debug", cfg.Debug) {
 						pterm.EnableDebugMessages()
 					}
 					startBanner()
-					return api.New(
-						api.WithWhitelist(c.StringSlice("whitelist")...),
-						api.WithListeningAddress(c.String("address")),
-						api.WithCacheStore(c.String("store")),
-						api.WithMagicDNS(c.String("dns")),
-						api.WithMaxSize(c.String("max-size")),
-						api.WithWorkers(c.Int("workers")),
-						api.WithCleanupInterval(c.String("cleanup")),
-						api.WithPoolSize(c.Int("pool")),
-						api.WithDefaultImage(c.String("default-image")),
-					).Start(echoConfig(c))
+					opts, err := serverOptions(c, cfg, option("whitelist", api.WithWhitelist(c.StringSlice("whitelist")...)))
+					if err != nil {
+						return err
+					}
+					return api.New(opts...).Start(echoConfig(boolFlag(c, "gzip", cfg.Gzip)))
+				},
+			},
+			{
+				Name:  "domain",
+				Usage: "bind domains to images",
+				Subcommands: []cli.Command{
+					{
+						Name:      "hostname",
+						Usage:     "compute the magic DNS host name serving an image",
+						ArgsUsage: "<image>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:   "dns",
+								Usage:  "magic dns address",
+								EnvVar: "CONTAINERBAY_MAGICDNS",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							if !c.Args().Present() {
+								return errors.New("need an image")
+							}
+							host, err := api.MagicDNSHost(c.Args().First(), c.String("dns"))
+							if err != nil {
+								return err
+							}
+							fmt.Println(host)
+							return nil
+						},
+					},
+					{
+						Name:      "token",
+						Usage:     "compute the verification token of the TXT record binding a domain to an image",
+						ArgsUsage: "<domain> <image>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:   "domain-secret",
+								Usage:  "secret the domain verification tokens are derived from",
+								EnvVar: "CONTAINERBAY_DOMAIN_SECRET",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 2 {
+								return errors.New("need a domain and an image")
+							}
+							if c.String("domain-secret") == "" {
+								return errors.New("need the domain secret")
+							}
+							token, err := api.DomainToken(c.String("domain-secret"), c.Args().Get(0), c.Args().Get(1))
+							if err != nil {
+								return err
+							}
+							fmt.Println(token)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "manage configuration files",
+				Subcommands: []cli.Command{
+					{
+						Name:      "validate",
+						Usage:     "validate a configuration file",
+						ArgsUsage: "<config.yaml>",
+						Action: func(c *cli.Context) error {
+							if !c.Args().Present() {
+								return errors.New("need a configuration file")
+							}
+							if _, err := api.LoadConfig(c.Args().First()); err != nil {
+								return err
+							}
+							pterm.Success.Printfln("'%s' is valid", c.Args().First())
+							return nil
+						},
+					},
 				},
 			},
 		},
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	indexFile = ".index.db"
+)
+
+var entriesBucket = []byte("entries")
+
+// Entry is the metadata the store keeps about
+// an image extracted in it
+type Entry struct {
+	Key       string   `json:"key"`
+	Reference string   `json:"reference"`
+	Platform  string   `json:"platform,omitempty"`
+	Digest    string   `json:"digest,omitempty"`
+	Index     string   `json:"index,omitempty"`
+	Layers    []string `json:"layers,omitempty"`
+	// Meta is set by the users of the store, about the extracted content
+	Meta        json.RawMessage `json:"meta,omitempty"`
+	Size        int64           `json:"size"`
+	ExtractedAt time.Time       `json:"extracted_at,omitempty"`
+	LastAccess  time.Time       `json:"last_access"`
+	Complete    bool            `json:"complete"`
+}
+
+// index persists the store entries metadata on disk, so
+// they can be recovered across restarts
+type index struct {
+	db *bolt.DB
+}
+
+func openIndex(path string) (*index, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(entriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &index{db: db}, nil
+}
+
+func (i *index) put(e Entry) error {
+	dat, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Put([]byte(e.Key), dat)
+	})
+}
+
+func (i *index) delete(key string) error {
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Delete([]byte(key))
+	})
+}
+
+func (i *index) all() (res []Entry, err error) {
+	err = i.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			e := Entry{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				// Don't fail on a corrupted entry, it will be dropped
+				e = Entry{Key: string(k)}
+			}
+			res = append(res, e)
+			return nil
+		})
+	})
+	return
+}
+
+func (i *index) close() error {
+	return i.db.Close()
+}
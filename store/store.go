@@ -1,24 +1,75 @@
 package store
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
 	"github.com/pterm/pterm"
 )
 
+const (
+	// accessFlushInterval is how often the last access time of an entry
+	// is written to the index
+	accessFlushInterval = time.Minute
+
+	stagingDir = ".staging"
+)
+
 // Store is a simple disk-cache store
 // for container images
 type Store struct {
 	sync.Mutex
 	dir string
+
+	maxSize int64
+	maxAge  time.Duration
+
+	index   *index
+	entries map[string]*entry
+}
+
+// entry tracks usage of a directory of the store
+type entry struct {
+	Entry
+	sized     bool
+	inUse     int
+	persisted time.Time
+}
+
+// Option is a generic handler which mutates a Store
+type Option func(s *Store)
+
+// WithMaxSize sets the max total size of the store. When exceeded,
+// least recently used entries are evicted first
+func WithMaxSize(i int64) Option {
+	return func(s *Store) {
+		s.maxSize = i
+	}
+}
+
+// WithMaxAge sets the max time an entry can stay in the store
+// without being accessed before being evicted
+func WithMaxAge(d time.Duration) Option {
+	return func(s *Store) {
+		s.maxAge = d
+	}
 }
 
 // New returns a new store in the specified directory
-func New(dir string) *Store {
-	return &Store{dir: dir}
+func New(dir string, opts ...Option) *Store {
+	s := &Store{dir: dir, entries: make(map[string]*entry)}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
 }
 
 // EnsureExists ensures the store directory exists and have the correct permissions
@@ -26,14 +77,116 @@ func (s *Store) EnsureExists() error {
 	return os.MkdirAll(s.dir, os.ModePerm)
 }
 
+// Open opens the store index and reconciles it with the store directory:
+// completed entries are kept, while partial ones and directories
+// unknown to the index are removed
+func (s *Store) Open() error {
+	if err := s.EnsureExists(); err != nil {
+		return err
+	}
+
+	// Anything left in staging is from downloads which never completed
+	if err := os.RemoveAll(s.Path(stagingDir)); err != nil {
+		return errors.Wrap(err, "while removing orphaned staging directories")
+	}
+	if err := os.MkdirAll(s.Path(stagingDir), os.ModePerm); err != nil {
+		return err
+	}
+
+	idx, err := openIndex(s.Path(indexFile))
+	if err != nil {
+		return errors.Wrap(err, "while opening the store index")
+	}
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	s.index = idx
+
+	entries, err := idx.all()
+	if err != nil {
+		return errors.Wrap(err, "while reading the store index")
+	}
+
+	for _, e := range entries {
+		if !e.Complete {
+			pterm.Warning.Printfln("Removing partial store entry '%s' (%s)", e.Key, e.Reference)
+			os.RemoveAll(s.Path(e.Key))
+			idx.delete(e.Key)
+			continue
+		}
+		if _, err := os.Stat(s.Path(e.Key)); err != nil {
+			idx.delete(e.Key)
+			continue
+		}
+		s.entries[e.Key] = &entry{Entry: e, sized: true, persisted: e.LastAccess}
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if _, ok := s.entries[f.Name()]; !ok {
+			pterm.Debug.Printfln("File '%s' not in the store index, pruned", f.Name())
+			os.RemoveAll(s.Path(f.Name()))
+		}
+	}
+
+	pterm.Info.Printfln("Recovered '%d' entries from the store index", len(s.entries))
+	return nil
+}
+
+// Close flushes the pending entries metadata and closes the store index
+func (s *Store) Close() error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if s.index == nil {
+		return nil
+	}
+	for _, e := range s.entries {
+		if e.Complete && e.persisted != e.LastAccess {
+			s.index.put(e.Entry)
+		}
+	}
+	err := s.index.close()
+	s.index = nil
+	return err
+}
+
 // Exists checks weather the given key exists in the cache
+// and its content is complete
 func (s *Store) Exists(ss string) bool {
+	s.Mutex.Lock()
+	e, ok := s.entries[ss]
+	complete := ok && e.Complete
+	s.Mutex.Unlock()
+
+	if !complete {
+		return false
+	}
 	if _, err := os.Stat(s.Path(ss)); err == nil {
 		return true
 	}
 	return false
 }
 
+// Get returns the metadata of the entry with the given key
+func (s *Store) Get(key string) (Entry, bool) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return Entry{}, false
+	}
+	return e.Entry, true
+}
+
 // Path is syntax sugar to return a subpath from the cache store
 func (s *Store) Path(p ...string) string {
 	return filepath.Join(append([]string{s.dir}, p...)...)
@@ -44,36 +197,257 @@ func (s *Store) String() string {
 	return s.dir
 }
 
-// CleanAll cleans up the cache store
-func (s *Store) CleanAll() error {
-	files, err := ioutil.ReadDir(s.dir)
-	if err != nil {
-		return err
+func (s *Store) entry(key string) *entry {
+	e, ok := s.entries[key]
+	if !ok {
+		e = &entry{Entry: Entry{Key: key, LastAccess: time.Now()}}
+		s.entries[key] = e
 	}
+	return e
+}
 
-	for _, f := range files {
-		os.RemoveAll(s.Path(f.Name()))
-		pterm.Debug.Printfln("File '%s' pruned", f.Name())
+func (s *Store) persist(e *entry) error {
+	if s.index == nil {
+		return nil
+	}
+	if err := s.index.put(e.Entry); err != nil {
+		return err
 	}
+	e.persisted = e.LastAccess
 	return nil
 }
 
+// access records an access to e, flushing it to the index
+// if it wasn't since a while
+func (s *Store) access(e *entry) {
+	e.LastAccess = time.Now()
+	if e.Complete && e.LastAccess.Sub(e.persisted) > accessFlushInterval {
+		s.persist(e)
+	}
+}
+
+// Begin records that the extraction of the entry with the given
+// metadata started
+func (s *Store) Begin(meta Entry) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	e := s.entry(meta.Key)
+	e.Reference = meta.Reference
+	e.Platform = meta.Platform
+	e.Digest = meta.Digest
+	e.Index = meta.Index
+	e.Layers = meta.Layers
+	e.Meta = nil
+	e.Complete = false
+	e.LastAccess = time.Now()
+	return s.persist(e)
+}
+
+// SetMeta sets the metadata about the content of the given key,
+// while it is being extracted
+func (s *Store) SetMeta(key string, meta json.RawMessage) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return errors.Errorf("'%s' is not in the store", key)
+	}
+	e.Meta = meta
+	return s.persist(e)
+}
+
+// Stage creates the staging directory where the content of the given key
+// is extracted before being committed. It fails with an error satisfying
+// os.IsExist if the key is already being staged.
+func (s *Store) Stage(key string) (string, error) {
+	dir := s.Path(stagingDir, key)
+	if err := os.Mkdir(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Commit atomically moves the staged content of the given key
+// in place, and marks it as complete
+func (s *Store) Commit(key string) error {
+	staging := s.Path(stagingDir, key)
+	defer os.RemoveAll(staging)
+
+	info, err := os.Stat(staging)
+	if err != nil {
+		return errors.Wrapf(err, "while committing '%s'", key)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("while committing '%s': staged content is not a directory", key)
+	}
+
+	if s.Exists(key) {
+		pterm.Debug.Printfln("'%s' already committed, discarding staged content", key)
+		return nil
+	}
+
+	// Clear any leftover which isn't tracked as complete
+	os.RemoveAll(s.Path(key))
+	if err := os.Rename(staging, s.Path(key)); err != nil {
+		return errors.Wrapf(err, "while committing '%s'", key)
+	}
+
+	return s.complete(key)
+}
+
+func (s *Store) complete(key string) error {
+	size := dirSize(s.Path(key))
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	e := s.entry(key)
+	e.Size = size
+	e.sized = true
+	e.Complete = true
+	e.ExtractedAt = time.Now()
+	e.LastAccess = e.ExtractedAt
+	return s.persist(e)
+}
+
+// Remove deletes the given key from the store
+func (s *Store) Remove(key string) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	return s.remove(key)
+}
+
+// RemoveWhere deletes the entries matching f from the store, including the
+// ones in use, and returns their keys
+func (s *Store) RemoveWhere(f func(Entry) bool) ([]string, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	removed := []string{}
+	for key, e := range s.entries {
+		if !f(e.Entry) {
+			continue
+		}
+		if err := s.remove(key); err != nil {
+			return removed, err
+		}
+		removed = append(removed, key)
+	}
+	return removed, nil
+}
+
+func (s *Store) remove(key string) error {
+	if e, ok := s.entries[key]; ok {
+		if e.inUse == 0 {
+			delete(s.entries, key)
+		} else {
+			e.Complete = false
+		}
+	}
+	if s.index != nil {
+		if err := s.index.delete(key); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(s.Path(key))
+}
+
+// Acquire marks the given key as in use, so it is never evicted
+// until the returned function is called
+func (s *Store) Acquire(key string) func() {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	e := s.entry(key)
+	e.inUse++
+	s.access(e)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.Mutex.Lock()
+			defer s.Mutex.Unlock()
+			e.inUse--
+			s.access(e)
+		})
+	}
+}
+
 // Clean cleans up the cache store only
-// from the elements that aren't currently accessed
+// from the elements that aren't currently accessed.
+// If the store has no size or age limits, all of them are removed,
+// otherwise entries are evicted as Prune does.
 func (s *Store) Clean() error {
+	if s.maxSize == 0 && s.maxAge == 0 {
+		return s.prune(func(*entry) bool { return true })
+	}
+	return s.Prune()
+}
+
+// Prune enforces the store limits: entries not accessed since
+// longer than the max age are evicted, then the least recently used
+// ones until the store fits in the max size.
+// Entries currently in use are never evicted.
+func (s *Store) Prune() error {
+	if s.maxSize == 0 && s.maxAge == 0 {
+		return nil
+	}
+	return s.prune(func(e *entry) bool {
+		return s.maxAge != 0 && time.Since(e.LastAccess) > s.maxAge
+	})
+}
+
+func (s *Store) prune(expired func(*entry) bool) error {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
 
-	files, err := ioutil.ReadDir(s.dir)
-	if err != nil {
-		return err
+	var total int64
+	var candidates []*entry
+	for key, e := range s.entries {
+		if _, err := os.Stat(s.Path(key)); err != nil {
+			if e.inUse == 0 {
+				s.remove(key)
+			}
+			continue
+		}
+		if e.inUse > 0 || !e.Complete {
+			total += e.Size
+			continue
+		}
+		if !e.sized {
+			e.Size = dirSize(s.Path(key))
+			e.sized = true
+		}
+		total += e.Size
+		candidates = append(candidates, e)
 	}
 
-	for _, f := range files {
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastAccess.Before(candidates[j].LastAccess)
+	})
 
-		pterm.Debug.Printfln("File '%s' pruned", f.Name())
-		os.RemoveAll(s.Path(f.Name()))
+	for _, e := range candidates {
+		if !expired(e) && (s.maxSize == 0 || total <= s.maxSize) {
+			continue
+		}
+		pterm.Debug.Printfln("File '%s' pruned (size: %s, last access: %s)", e.Key, units.HumanSize(float64(e.Size)), e.LastAccess)
+		s.remove(e.Key)
+		total -= e.Size
 	}
 
 	return nil
 }
+
+// dirSize returns the size of the regular files under dir
+func dirSize(dir string) (size int64) {
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
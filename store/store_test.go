@@ -0,0 +1,182 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T, dir string, opts ...Option) *Store {
+	s := New(dir, opts...)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// commit stores content for key, accessed last at lastAccess
+func commit(t *testing.T, s *Store, key, content string, lastAccess time.Time) {
+	if err := s.Begin(Entry{Key: key, Reference: "example.com/" + key}); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := s.Stage(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(key); err != nil {
+		t.Fatal(err)
+	}
+	s.Lock()
+	s.entries[key].LastAccess = lastAccess
+	s.Unlock()
+}
+
+// existing returns the keys which exist in s
+func existing(s *Store, keys ...string) (res []string) {
+	for _, k := range keys {
+		if s.Exists(k) {
+			res = append(res, k)
+		}
+	}
+	return
+}
+
+func TestPruneLeastRecentlyUsed(t *testing.T) {
+	s := open(t, t.TempDir(), WithMaxSize(250))
+	now := time.Now()
+	commit(t, s, "a", strings.Repeat("a", 100), now.Add(-3*time.Minute))
+	commit(t, s, "b", strings.Repeat("b", 100), now.Add(-time.Minute))
+	commit(t, s, "c", strings.Repeat("c", 100), now.Add(-2*time.Minute))
+
+	if err := s.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if k := strings.Join(existing(s, "a", "b", "c"), ","); k != "b,c" {
+		t.Fatalf("expected the least recently used entry to be evicted, got %s", k)
+	}
+
+	// Accessing c makes b the least recently used
+	s.Acquire("c")()
+	s.maxSize = 150
+	if err := s.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if k := strings.Join(existing(s, "a", "b", "c"), ","); k != "c" {
+		t.Fatalf("expected the least recently used entry to be evicted, got %s", k)
+	}
+}
+
+func TestPruneMaxAge(t *testing.T) {
+	s := open(t, t.TempDir(), WithMaxAge(time.Hour))
+	commit(t, s, "old", "old", time.Now().Add(-2*time.Hour))
+	commit(t, s, "new", "new", time.Now())
+
+	if err := s.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if k := strings.Join(existing(s, "old", "new"), ","); k != "new" {
+		t.Fatalf("expected the expired entry to be evicted, got %s", k)
+	}
+}
+
+func TestPruneInUse(t *testing.T) {
+	s := open(t, t.TempDir(), WithMaxSize(50), WithMaxAge(time.Hour))
+	old := time.Now().Add(-2 * time.Hour)
+	commit(t, s, "a", strings.Repeat("a", 100), old)
+	commit(t, s, "b", strings.Repeat("b", 100), old)
+
+	release := s.Acquire("a")
+	for _, clean := range []func() error{s.Prune, s.Clean} {
+		if err := clean(); err != nil {
+			t.Fatal(err)
+		}
+		if k := strings.Join(existing(s, "a", "b"), ","); k != "a" {
+			t.Fatalf("expected only the entry in use to be kept, got %s", k)
+		}
+	}
+
+	release()
+	s.maxSize = 0
+	s.maxAge = 0
+	if err := s.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if k := existing(s, "a"); len(k) != 0 {
+		t.Fatal("expected the released entry to be evicted")
+	}
+}
+
+func TestOpenRemovesPartialEntries(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, s, "complete", "complete", time.Now())
+
+	// A download interrupted while extracting, and leftovers
+	if err := s.Begin(Entry{Key: "partial"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stage("partial"); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"partial", "unindexed"} {
+		if err := os.Mkdir(s.Path(d), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = open(t, dir)
+	if !s.Exists("complete") {
+		t.Error("expected the complete entry to be recovered")
+	}
+	if _, ok := s.Get("partial"); ok {
+		t.Error("expected the partial entry to be removed from the index")
+	}
+	for _, p := range []string{"partial", "unindexed", filepath.Join(stagingDir, "partial")} {
+		if _, err := os.Stat(s.Path(p)); !os.IsNotExist(err) {
+			t.Errorf("expected '%s' to be removed", p)
+		}
+	}
+	if _, err := os.Stat(s.Path(indexFile)); err != nil {
+		t.Errorf("expected the index to be kept: %s", err)
+	}
+}
+
+func TestCommitExistingKey(t *testing.T) {
+	s := open(t, t.TempDir())
+	commit(t, s, "a", "first", time.Now())
+
+	dir, err := s.Stage("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	dat, err := ioutil.ReadFile(s.Path("a", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dat) != "first" {
+		t.Errorf("expected the committed content to be kept, got %q", dat)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("expected the staged content to be discarded")
+	}
+}